@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// aliases let one set of images answer to more than one name. they're kept in a
+// single small JSON object, mapping each alias to the name it stands for, that
+// lives alongside the images:
+//
+//	<prefix>/.aliases.json
+//
+// the file is hidden so it never shows up as a name, and a localdump never
+// serves it.
+//
+// an alias can point at another alias, so resolving one follows the chain until
+// it gets to a name that isn't an alias. the bot refuses to create cycles, but
+// the file can be edited by hand, so resolving still checks.
+
+// ErrAliasCycle is returned when resolving an alias leads back to itself.
+var ErrAliasCycle = fmt.Errorf("imgdump: alias cycle")
+
+// the key for the alias map
+func aliasesKey(prefix string) string {
+	return path.Join(prefix, ".aliases.json")
+}
+
+// follow aliases from name until getting to a name that isn't an alias. names
+// that aren't aliases resolve to themselves.
+func resolveAlias(aliases map[string]string, name string) (string, error) {
+	seen := make(map[string]bool)
+	for {
+		target, isAlias := aliases[name]
+		if !isAlias {
+			return name, nil
+		}
+		if seen[name] {
+			return "", ErrAliasCycle
+		}
+		seen[name] = true
+		name = target
+	}
+}
+
+// the aliases in a map, sorted.
+func sortedAliases(aliases map[string]string) []string {
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveAlias(t *testing.T) {
+	aliases := map[string]string{
+		"garfield": "garf",
+		"fat-cat":  "garfield",
+		"odie":     "odie",
+		"jon":      "arbuckle",
+		"arbuckle": "jonathan",
+		"jonathan": "jon",
+		"nermal":   "nermal-2",
+		"🍝":        "lasagna",
+		"comics/🐱": "garf",
+	}
+
+	tcs := []struct {
+		name     string
+		resolved string
+		err      error
+	}{
+		{name: "garf", resolved: "garf"},
+		{name: "garfield", resolved: "garf"},
+		{name: "fat-cat", resolved: "garf"},
+		{name: "nermal", resolved: "nermal-2"},
+		{name: "🍝", resolved: "lasagna"},
+		{name: "comics/🐱", resolved: "garf"},
+		{name: "pooky", resolved: "pooky"},
+		{name: "odie", err: ErrAliasCycle},
+		{name: "jon", err: ErrAliasCycle},
+		{name: "arbuckle", err: ErrAliasCycle},
+	}
+
+	for _, tc := range tcs {
+		resolved, err := resolveAlias(aliases, tc.name)
+		assert.Equal(t, tc.err, err, "%s: wrong error", tc.name)
+		assert.Equal(t, tc.resolved, resolved, "%s: wrong name", tc.name)
+	}
+}
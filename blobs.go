@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"path"
+)
+
+// images are content addressed. the bytes of every image are stored exactly
+// once, as a blob named after the image's id, no matter how many names it's
+// pinned under:
+//
+//	<prefix>/blobs/<image_sha256>.<filetype>
+//
+// pinning an image under a name creates an empty reference object at the same
+// key images have always had, and that's what holds the image's metadata and
+// tags:
+//
+//	<prefix>/<name>/<image_sha256>.<filetype>
+//
+// blobs have to be cleaned up once nothing refers to them, and finding every
+// reference to a blob by listing every name would be way too slow. so every
+// reference also gets an empty marker under its blob:
+//
+//	<prefix>/blobs/<image_sha256>/<name>
+//
+// when the last marker for a blob is deleted, so is the blob. markers are
+// written before blobs and references, so a crash can leave a marker for a
+// reference that doesn't exist but never a reference without a marker.
+//
+// images pinned before blobs existed have their bytes in the reference itself.
+// those still work - anything that isn't empty is treated as an image, and it
+// keeps the url it's always had. `lasagnad migrate-blobs` makes blobs for them.
+const blobsDir = "blobs"
+
+// a blobMigrator is an imageStore that can make blobs for images pinned before
+// blobs existed.
+type blobMigrator interface {
+	// make sure every image has a blob and a reference marker, and return the
+	// number of images that needed one. running it twice is fine.
+	migrateBlobs(ctx context.Context) (int, error)
+}
+
+// the key for an image's blob.
+func blobKey(prefix, filetype string, id imgid) string {
+	return path.Join(prefix, blobsDir, id.String()+extension(filetype))
+}
+
+// the prefix every reference marker for a blob is under. ends with a /
+func blobRefsPrefix(prefix string, id imgid) string {
+	return path.Join(prefix, blobsDir, id.String()) + "/"
+}
+
+// the key for the marker that says name refers to a blob. like s3key, name
+// has to be a valid pin name.
+func blobRefKey(prefix, name string, id imgid) string {
+	return blobRefsPrefix(prefix, id) + encodePinName(name)
+}
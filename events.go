@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	slackSignatureHeader  = "X-Slack-Signature"
+	slackTimestampHeader  = "X-Slack-Request-Timestamp"
+	slackRetryNumHeader   = "X-Slack-Retry-Num"
+	slackSignatureVersion = "v0"
+
+	// requests older than this are rejected to make replaying them harder.
+	// this is the window Slack recommends.
+	maxEventAge = 5 * time.Minute
+
+	// Slack never sends anything close to this, so anything bigger is junk.
+	maxEventBytes = 1 << 20
+
+	// how long to remember an event after handling it. Slack gives up retrying
+	// after about five minutes, so this is plenty.
+	seenEventTTL = 15 * time.Minute
+)
+
+// an eventsHandler receives callbacks from the Slack Events API over HTTP and
+// turns them into the same *slack.RTMEvents that come in over the RTM API.
+//
+// every request has to be signed with the app's signing secret. see
+// https://api.slack.com/docs/verifying-requests-from-slack
+type eventsHandler struct {
+	SigningSecret string
+	Logger        logrus.FieldLogger
+
+	// called for every event that comes in. Handle shouldn't block: Slack wants
+	// a response within three seconds and handling a message can take longer
+	// than that, so it should hand the event off and return.
+	Handle func(log logrus.FieldLogger, requestID string, event *slack.RTMEvent)
+
+	// the current time. defaults to time.Now
+	now func() time.Time
+
+	// events that have already been handled
+	seen seenEvents
+}
+
+// the outer envelope of an Events API request. Event is only set for event
+// callbacks and Challenge is only set for url verification.
+type eventsEnvelope struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	EventID   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := uuid.New().String()
+	log := h.Logger.WithField("request_id", requestID)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventBytes))
+	if err != nil {
+		log.WithError(err).Info("reading event failed")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.verify(r.Header, body); err != nil {
+		log.WithError(err).Info("invalid signature")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var envelope eventsEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		log.WithError(err).Info("invalid event")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	switch envelope.Type {
+	case "url_verification":
+		log.Info("url verification")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(envelope.Challenge))
+	case "event_callback":
+		log = log.WithField("event_id", envelope.EventID)
+		if retry := r.Header.Get(slackRetryNumHeader); retry != "" {
+			log = log.WithField("retry", retry)
+		}
+
+		event, err := parseEvent(envelope.Event)
+		if err != nil {
+			log.WithError(err).Info("invalid event")
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// Slack retries an event when it doesn't get an ack, which happens when
+		// an ack is slow as well as when the event never made it here. only
+		// handle the retries of events that haven't been handled yet.
+		if !h.seen.add(envelope.EventID, h.clock()) {
+			log.Info("ignoring an event that's already been handled")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if event != nil {
+			h.Handle(log, requestID, event)
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		log.WithField("type", envelope.Type).Debug("unknown event type")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// the current time.
+func (h *eventsHandler) clock() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+// verify a request's signature and timestamp.
+func (h *eventsHandler) verify(header http.Header, body []byte) error {
+	timestamp := header.Get(slackTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("events: invalid timestamp %q", timestamp)
+	}
+	if age := h.clock().Sub(time.Unix(seconds, 0)); age > maxEventAge || age < -maxEventAge {
+		return fmt.Errorf("events: stale timestamp %q", timestamp)
+	}
+
+	expected := signEvent(h.SigningSecret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(slackSignatureHeader))) {
+		return fmt.Errorf("events: signature mismatch")
+	}
+
+	return nil
+}
+
+// a seenEvents is the set of event ids handled in the last seenEventTTL. the
+// zero value is empty and ready to use.
+type seenEvents struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	nextSweep time.Time
+}
+
+// add an event id to the set. returns false if it was already there. events
+// without an id are never considered seen.
+func (s *seenEvents) add(id string, now time.Time) bool {
+	if id == "" {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget expired ids every once in a while instead of on every event
+	if now.After(s.nextSweep) {
+		for seen, expires := range s.expires {
+			if !now.Before(expires) {
+				delete(s.expires, seen)
+			}
+		}
+		s.nextSweep = now.Add(seenEventTTL)
+	}
+
+	if expires, ok := s.expires[id]; ok && now.Before(expires) {
+		return false
+	}
+	if s.expires == nil {
+		s.expires = make(map[string]time.Time)
+	}
+	s.expires[id] = now.Add(seenEventTTL)
+	return true
+}
+
+// sign a request body the way Slack does. the signature is the hex HMAC-SHA256
+// of the version, timestamp and body joined with colons.
+func signEvent(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%s:", slackSignatureVersion, timestamp)
+	mac.Write(body)
+	return slackSignatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// turn the inner event of an event callback into an RTM event. returns nil
+// without an error for events the bot doesn't care about.
+func parseEvent(raw json.RawMessage) (*slack.RTMEvent, error) {
+	var event slack.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+
+	switch event.Type {
+	case "message":
+		message := &slack.MessageEvent{}
+		if err := json.Unmarshal(raw, message); err != nil {
+			return nil, err
+		}
+		return &slack.RTMEvent{Type: event.Type, Data: message}, nil
+	case "reaction_added":
+		reaction := &slack.ReactionAddedEvent{}
+		if err := json.Unmarshal(raw, reaction); err != nil {
+			return nil, err
+		}
+		return &slack.RTMEvent{Type: event.Type, Data: reaction}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// start an events server that sends every event it handles down a channel.
+func testEventsServer(t *testing.T) (*httptest.Server, chan *slack.RTMEvent) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	events := make(chan *slack.RTMEvent, 1)
+	server := httptest.NewServer(&eventsHandler{
+		SigningSecret: testSigningSecret,
+		Logger:        logger,
+		Handle: func(_ logrus.FieldLogger, _ string, event *slack.RTMEvent) {
+			events <- event
+		},
+	})
+
+	return server, events
+}
+
+// post a payload to an events server, signed with the given secret and time.
+func postEvent(t *testing.T, server *httptest.Server, secret string, at time.Time, body string, headers map[string]string) *http.Response {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set(slackTimestampHeader, timestamp)
+	req.Header.Set(slackSignatureHeader, signEvent(secret, timestamp, []byte(body)))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestEventsURLVerification(t *testing.T) {
+	server, _ := testEventsServer(t)
+	defer server.Close()
+
+	resp := postEvent(t, server, testSigningSecret, time.Now(), `{
+		"token": "Jhj5dZrVaK7ZwHHjRyZWjbDl",
+		"challenge": "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P",
+		"type": "url_verification"
+	}`, nil)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P", string(body))
+}
+
+func TestEventsMessage(t *testing.T) {
+	server, events := testEventsServer(t)
+	defer server.Close()
+
+	resp := postEvent(t, server, testSigningSecret, time.Now(), `{
+		"type": "event_callback",
+		"event_id": "Ev0PV52K21",
+		"event": {
+			"type": "message",
+			"channel": "C2147483705",
+			"user": "U2147483697",
+			"text": "!show garf",
+			"ts": "1355517523.000005"
+		}
+	}`, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case event := <-events:
+		message, isMessage := event.Data.(*slack.MessageEvent)
+		require.True(t, isMessage, "expected a *slack.MessageEvent")
+		assert.Equal(t, "C2147483705", message.Channel)
+		assert.Equal(t, "U2147483697", message.User)
+		assert.Equal(t, "!show garf", message.Text)
+	case <-time.After(time.Second):
+		t.Fatal("message was never handled")
+	}
+}
+
+func TestEventsRejected(t *testing.T) {
+	server, events := testEventsServer(t)
+	defer server.Close()
+
+	body := `{"type": "event_callback", "event": {"type": "message", "text": "!show garf"}}`
+
+	tcs := []struct {
+		desc    string
+		secret  string
+		at      time.Time
+		headers map[string]string
+		code    int
+	}{
+		{desc: "wrong secret", secret: "garf", at: time.Now(), code: http.StatusUnauthorized},
+		{desc: "stale", secret: testSigningSecret, at: time.Now().Add(-time.Hour), code: http.StatusUnauthorized},
+		{desc: "future", secret: testSigningSecret, at: time.Now().Add(time.Hour), code: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tcs {
+		resp := postEvent(t, server, tc.secret, tc.at, body, tc.headers)
+		resp.Body.Close()
+		assert.Equal(t, tc.code, resp.StatusCode, "%s: wrong status", tc.desc)
+	}
+
+	select {
+	case <-events:
+		t.Fatal("no events should have been handled")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventsRetries(t *testing.T) {
+	server, events := testEventsServer(t)
+	defer server.Close()
+
+	message := func(id string) string {
+		return `{
+			"type": "event_callback",
+			"event_id": "` + id + `",
+			"event": {"type": "message", "channel": "C2147483705", "user": "U2147483697", "text": "!show garf"}
+		}`
+	}
+
+	tcs := []struct {
+		desc    string
+		id      string
+		retry   string
+		handled bool
+	}{
+		{desc: "retry of an event that never made it", id: "Ev0PV52K21", retry: "1", handled: true},
+		{desc: "retry of a handled event", id: "Ev0PV52K21", retry: "2", handled: false},
+		{desc: "new event", id: "Ev0PV52K22", handled: true},
+		{desc: "retry of a new event", id: "Ev0PV52K22", retry: "1", handled: false},
+	}
+
+	for _, tc := range tcs {
+		var headers map[string]string
+		if tc.retry != "" {
+			headers = map[string]string{slackRetryNumHeader: tc.retry}
+		}
+		resp := postEvent(t, server, testSigningSecret, time.Now(), message(tc.id), headers)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, "%s: wrong status", tc.desc)
+
+		select {
+		case <-events:
+			assert.True(t, tc.handled, "%s: shouldn't have been handled", tc.desc)
+		case <-time.After(100 * time.Millisecond):
+			assert.False(t, tc.handled, "%s: should have been handled", tc.desc)
+		}
+	}
+}
+
+func TestSeenEvents(t *testing.T) {
+	var seen seenEvents
+	now := time.Now()
+
+	assert.True(t, seen.add("Ev0PV52K21", now))
+	assert.False(t, seen.add("Ev0PV52K21", now.Add(time.Minute)))
+	assert.True(t, seen.add("", now))
+	assert.True(t, seen.add("", now))
+
+	// expired ids are handled again, and eventually swept away
+	assert.True(t, seen.add("Ev0PV52K21", now.Add(seenEventTTL)))
+	assert.True(t, seen.add("Ev0PV52K22", now.Add(3*seenEventTTL)))
+	assert.Len(t, seen.expires, 1)
+}
+
+func TestEventsReaction(t *testing.T) {
+	server, events := testEventsServer(t)
+	defer server.Close()
+
+	resp := postEvent(t, server, testSigningSecret, time.Now(), `{
+		"type": "event_callback",
+		"event_id": "Ev0PV52K25",
+		"event": {
+			"type": "reaction_added",
+			"user": "U2147483697",
+			"reaction": "pushpin",
+			"item": {"type": "message", "channel": "C2147483705", "ts": "1355517523.000005"},
+			"event_ts": "1360782804.083113"
+		}
+	}`, nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case event := <-events:
+		reaction, isReaction := event.Data.(*slack.ReactionAddedEvent)
+		require.True(t, isReaction, "expected a *slack.ReactionAddedEvent")
+		assert.Equal(t, "U2147483697", reaction.User)
+		assert.Equal(t, "pushpin", reaction.Reaction)
+		assert.Equal(t, "C2147483705", reaction.Item.Channel)
+		assert.Equal(t, "1355517523.000005", reaction.Item.Timestamp)
+	case <-time.After(time.Second):
+		t.Fatal("reaction was never handled")
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a fakeS3 is an in-memory S3 bucket. it's just enough of the S3 API to test an
+// imgdump with, using path-style urls, and it doesn't check signatures.
+type fakeS3 struct {
+	Bucket string
+
+	// the most keys and common prefixes to return from a single ListObjects.
+	// anything less than S3's max of 1000 is handy for testing pagination.
+	PageSize int
+
+	// if set, truncated ListObjects responses don't include a NextMarker, which
+	// is what S3 does without a delimiter.
+	OmitNextMarker bool
+
+	// operations, like "PutObject", that fail with an AccessDenied.
+	Fail map[string]bool
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	requests map[string]int
+}
+
+// a fakeObject is everything a fakeS3 keeps for an object.
+type fakeObject struct {
+	Body         []byte
+	ContentType  string
+	ACL          string
+	Metadata     map[string]string
+	Tags         url.Values
+	LastModified time.Time
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		Bucket:   bucket,
+		Fail:     make(map[string]bool),
+		objects:  make(map[string]*fakeObject),
+		requests: make(map[string]int),
+	}
+}
+
+// start a fakeS3 and an imgdump that talks to it.
+func testImgdump(t *testing.T) (*imgdump, *fakeS3, func()) {
+	fake := newFakeS3("garf")
+	server := httptest.NewServer(fake)
+
+	client, err := s3Config{
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "AKIDGARF",
+		SecretAccessKey: "lasagna",
+	}.client()
+	require.NoError(t, err)
+
+	dump := &imgdump{S3: client, Bucket: fake.Bucket, Prefix: "lasagna", ACL: "public-read"}
+	return dump, fake, server.Close
+}
+
+// change a fakeS3's settings while it's serving requests.
+func (f *fakeS3) Configure(configure func(f *fakeS3)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	configure(f)
+}
+
+// the object at key, or nil if there isn't one.
+func (f *fakeS3) Object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+// how many times an operation has been called.
+func (f *fakeS3) Requests(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[op]
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+type fakeS3Contents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type fakeS3Prefix struct {
+	Prefix string
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Marker         string
+	NextMarker     string `xml:",omitempty"`
+	Delimiter      string `xml:",omitempty"`
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []fakeS3Contents
+	CommonPrefixes []fakeS3Prefix
+}
+
+type fakeS3Tag struct {
+	Key   string
+	Value string
+}
+
+type fakeS3Tagging struct {
+	XMLName xml.Name    `xml:"Tagging"`
+	TagSet  []fakeS3Tag `xml:"TagSet>Tag"`
+}
+
+type fakeS3CopyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// path-style urls are /bucket/key. the SDK escapes keys, so the decoded path
+	// has the key exactly as it was passed in.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.Bucket {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	_, tagging := r.URL.Query()["tagging"]
+
+	var op string
+	switch {
+	case key == "" && r.Method == http.MethodPut:
+		op = "CreateBucket"
+	case key == "" && r.Method == http.MethodGet:
+		op = "ListObjects"
+	case tagging && r.Method == http.MethodGet:
+		op = "GetObjectTagging"
+	case tagging && r.Method == http.MethodPut:
+		op = "PutObjectTagging"
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		op = "CopyObject"
+	case r.Method == http.MethodPut:
+		op = "PutObject"
+	case r.Method == http.MethodGet:
+		op = "GetObject"
+	case r.Method == http.MethodHead:
+		op = "HeadObject"
+	case r.Method == http.MethodDelete:
+		op = "DeleteObject"
+	default:
+		f.writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[op]++
+	if f.Fail[op] {
+		f.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	switch op {
+	case "CreateBucket":
+	case "ListObjects":
+		f.list(w, r)
+	case "PutObject":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		tags, _ := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+		f.objects[key] = &fakeObject{
+			Body:         body,
+			ContentType:  r.Header.Get("Content-Type"),
+			ACL:          r.Header.Get("X-Amz-Acl"),
+			Metadata:     fakeS3Metadata(r.Header),
+			Tags:         tags,
+			LastModified: time.Now().UTC(),
+		}
+	case "CopyObject":
+		f.copy(w, r, key)
+	case "GetObject", "HeadObject":
+		obj, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range obj.Metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("Content-Type", obj.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.Body)))
+		w.Header().Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+		if op == "GetObject" {
+			w.Write(obj.Body)
+		}
+	case "DeleteObject":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "GetObjectTagging":
+		obj, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var tagging fakeS3Tagging
+		for k := range obj.Tags {
+			tagging.TagSet = append(tagging.TagSet, fakeS3Tag{Key: k, Value: obj.Tags.Get(k)})
+		}
+		f.writeXML(w, tagging)
+	case "PutObjectTagging":
+		obj, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var tagging fakeS3Tagging
+		if err := xml.NewDecoder(r.Body).Decode(&tagging); err != nil {
+			f.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		obj.Tags = url.Values{}
+		for _, tag := range tagging.TagSet {
+			obj.Tags.Set(tag.Key, tag.Value)
+		}
+	}
+}
+
+// ListObjects, with a marker and a delimiter. like S3, keys and common prefixes
+// both count towards the page size, and a common prefix is only ever returned
+// once.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, delimiter, marker := query.Get("prefix"), query.Get("delimiter"), query.Get("marker")
+
+	maxKeys := 1000
+	if f.PageSize > 0 {
+		maxKeys = f.PageSize
+	}
+	if requested, err := strconv.Atoi(query.Get("max-keys")); err == nil && requested < maxKeys {
+		maxKeys = requested
+	}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := fakeS3ListResult{
+		Name:      f.Bucket,
+		Prefix:    prefix,
+		Marker:    marker,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	var last string
+	for _, key := range keys {
+		entry, isPrefix := key, false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry, isPrefix = key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if isPrefix && (entry == last || entry <= marker) {
+			continue
+		}
+
+		if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakeS3Prefix{Prefix: entry})
+		} else {
+			obj := f.objects[key]
+			result.Contents = append(result.Contents, fakeS3Contents{
+				Key:          key,
+				LastModified: obj.LastModified.Format(time.RFC3339),
+				ETag:         fmt.Sprintf("%q", md5Imgid(obj.Body)),
+				Size:         len(obj.Body),
+				StorageClass: "STANDARD",
+			})
+		}
+		last = entry
+	}
+	if result.IsTruncated && delimiter != "" && !f.OmitNextMarker {
+		result.NextMarker = last
+	}
+
+	f.writeXML(w, result)
+}
+
+// CopyObject. metadata and tags are copied unless the request says to replace
+// them.
+func (f *fakeS3) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		f.writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.Bucket+"/")
+	original, ok := f.objects[source]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	copied := *original
+	copied.ACL = r.Header.Get("X-Amz-Acl")
+	copied.LastModified = time.Now().UTC()
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		copied.ContentType = r.Header.Get("Content-Type")
+		copied.Metadata = fakeS3Metadata(r.Header)
+	}
+	if r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+		copied.Tags, _ = url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	}
+	f.objects[key] = &copied
+
+	f.writeXML(w, fakeS3CopyResult{
+		LastModified: copied.LastModified.Format(time.RFC3339),
+		ETag:         fmt.Sprintf("%q", md5Imgid(copied.Body)),
+	})
+}
+
+// the x-amz-meta- headers on a request, by lowercased name.
+func fakeS3Metadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for k := range header {
+		if lower := strings.ToLower(k); strings.HasPrefix(lower, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(lower, "x-amz-meta-")] = header.Get(k)
+		}
+	}
+	return metadata
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, v interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(fakeS3Error{Code: code, Message: code})
+}
+
+func TestFakeS3ListPagination(t *testing.T) {
+	fake := newFakeS3("garf")
+	for _, key := range []string{"a/1", "a/2", "b", "c/1", "c/2", "d", "e"} {
+		fake.objects[key] = &fakeObject{}
+	}
+	fake.PageSize = 2
+
+	var pages [][]string
+	marker := ""
+	for {
+		resp := httptest.NewRecorder()
+		target := "/garf?delimiter=%2F&marker=" + url.QueryEscape(marker)
+		fake.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		var result fakeS3ListResult
+		require.NoError(t, xml.Unmarshal(resp.Body.Bytes(), &result))
+
+		var page []string
+		for _, p := range result.CommonPrefixes {
+			page = append(page, p.Prefix)
+		}
+		for _, c := range result.Contents {
+			page = append(page, c.Key)
+		}
+		sort.Strings(page)
+		pages = append(pages, page)
+
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextMarker
+	}
+
+	assert.Equal(t, [][]string{{"a/", "b"}, {"c/", "d"}, {"e"}}, pages)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenURL is returned from fetchImageBytes when a fetchPolicy doesn't
+// allow fetching a URL, or any of the URLs it redirects to.
+var ErrForbiddenURL = fmt.Errorf("image: forbidden url")
+
+// the most redirects a fetch will follow. this is the same as the net/http
+// default.
+const maxRedirects = 10
+
+// networks that are never ok to fetch from, on top of the ones the net package
+// already knows how to detect.
+var forbiddenNetworks = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private, RFC 1918
+	"100.64.0.0/10",  // carrier grade NAT
+	"172.16.0.0/12",  // private, RFC 1918
+	"192.168.0.0/16", // private, RFC 1918
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, including broadcast
+	"64:ff9b::/96",   // NAT64, which can map to anything in IPv4
+	"fc00::/7",       // unique local, the IPv6 version of private
+)
+
+// a fetchPolicy decides where lasagnad is allowed to fetch images from. the bot
+// has AWS credentials and is probably running inside someone's network, so
+// it shouldn't fetch anything that isn't on the public internet.
+//
+// only http and https URLs are allowed, and nothing that resolves to a
+// loopback, link-local, private, multicast or otherwise reserved address is
+// ever fetched. the address check happens when connecting, after DNS has been
+// resolved, so it also applies to every redirect and can't be dodged with DNS
+// tricks.
+//
+// if AllowDomains isn't empty, only those domains and their subdomains can be
+// fetched. DenyDomains and their subdomains can never be fetched.
+type fetchPolicy struct {
+	AllowDomains []string
+	DenyDomains  []string
+}
+
+// build an http.Client that enforces this policy on every request it makes.
+// the client doesn't use any proxies from the environment, since a proxy would
+// do its own DNS and dodge the address check.
+func (p *fetchPolicy) client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkIP(net.ParseIP(host))
+		},
+	}
+
+	return &http.Client{
+		Transport: &policyTransport{
+			policy: p,
+			base: &http.Transport{
+				DialContext:           dialer.DialContext,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   timeout,
+				ExpectContinueTimeout: time.Second,
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("image: stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// check that a URL is allowed by this policy. this doesn't check the address
+// the URL's host resolves to.
+func (p *fetchPolicy) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrForbiddenURL
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return ErrForbiddenURL
+	}
+
+	// IP literals still get checked when dialing, but there's no reason to get
+	// that far.
+	if ip := net.ParseIP(host); ip != nil {
+		if err := checkIP(ip); err != nil {
+			return err
+		}
+	}
+
+	if len(p.AllowDomains) > 0 && !matchesDomain(host, p.AllowDomains) {
+		return ErrForbiddenURL
+	}
+	if matchesDomain(host, p.DenyDomains) {
+		return ErrForbiddenURL
+	}
+
+	return nil
+}
+
+// a policyTransport checks every request against a policy before sending it,
+// which covers both the first request and every redirect.
+type policyTransport struct {
+	policy *fetchPolicy
+	base   http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// check that an IP is a public unicast address.
+func checkIP(ip net.IP) error {
+	if ip == nil {
+		return ErrForbiddenURL
+	}
+
+	if ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return ErrForbiddenURL
+	}
+
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return ErrForbiddenURL
+		}
+	}
+
+	return nil
+}
+
+// true if host is one of the domains or a subdomain of one of them.
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if an error returned from an http.Client was caused by a fetchPolicy.
+// net/http buries dial errors a couple of layers deep.
+func isForbidden(err error) bool {
+	for err != nil {
+		if err == ErrForbiddenURL {
+			return true
+		}
+
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
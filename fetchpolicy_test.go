@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIP(t *testing.T) {
+	tcs := []struct {
+		ip      string
+		allowed bool
+	}{
+		{ip: "93.184.216.34", allowed: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", allowed: true},
+		{ip: "127.0.0.1", allowed: false},
+		{ip: "::1", allowed: false},
+		{ip: "::ffff:127.0.0.1", allowed: false},
+		{ip: "169.254.169.254", allowed: false},
+		{ip: "fe80::1", allowed: false},
+		{ip: "10.1.2.3", allowed: false},
+		{ip: "172.16.0.1", allowed: false},
+		{ip: "192.168.1.1", allowed: false},
+		{ip: "fd00::1", allowed: false},
+		{ip: "100.64.0.1", allowed: false},
+		{ip: "224.0.0.1", allowed: false},
+		{ip: "ff02::1", allowed: false},
+		{ip: "0.0.0.0", allowed: false},
+		{ip: "255.255.255.255", allowed: false},
+		{ip: "64:ff9b::a9fe:a9fe", allowed: false},
+	}
+
+	for _, tc := range tcs {
+		err := checkIP(net.ParseIP(tc.ip))
+		if tc.allowed {
+			assert.NoError(t, err, "%s: should be allowed", tc.ip)
+		} else {
+			assert.Equal(t, ErrForbiddenURL, err, "%s: should be forbidden", tc.ip)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	policy := &fetchPolicy{
+		AllowDomains: []string{"imgur.com", "giphy.com"},
+		DenyDomains:  []string{"evil.giphy.com"},
+	}
+
+	tcs := []struct {
+		url     string
+		allowed bool
+	}{
+		{url: "https://imgur.com/garf.gif", allowed: true},
+		{url: "http://i.imgur.com/garf.gif", allowed: true},
+		{url: "https://I.IMGUR.COM./garf.gif", allowed: true},
+		{url: "https://media.giphy.com/garf.gif", allowed: true},
+		{url: "https://evil.giphy.com/garf.gif", allowed: false},
+		{url: "https://very.evil.giphy.com/garf.gif", allowed: false},
+		{url: "https://notimgur.com/garf.gif", allowed: false},
+		{url: "https://imgur.com.evil.com/garf.gif", allowed: false},
+		{url: "ftp://imgur.com/garf.gif", allowed: false},
+		{url: "file:///etc/passwd", allowed: false},
+		{url: "http://169.254.169.254/latest/meta-data/", allowed: false},
+	}
+
+	for _, tc := range tcs {
+		u, err := url.Parse(tc.url)
+		require.NoError(t, err, "test setup failed")
+
+		err = policy.checkURL(u)
+		if tc.allowed {
+			assert.NoError(t, err, "%s: should be allowed", tc.url)
+		} else {
+			assert.Equal(t, ErrForbiddenURL, err, "%s: should be forbidden", tc.url)
+		}
+	}
+}
+
+func TestFetchForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("shh, i'm an internal service"))
+	}))
+	defer server.Close()
+
+	// httptest servers listen on loopback, which is exactly what the policy
+	// should stop. use a hostname so the check happens at dial time instead of
+	// when checking the URL.
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	u.Host = net.JoinHostPort("localhost", u.Port())
+
+	client := (&fetchPolicy{}).client(time.Second)
+	_, _, err = fetchImageBytes(context.Background(), client, u, testImageLimits)
+	assert.Equal(t, ErrForbiddenURL, err)
+}
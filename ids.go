@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// an idVersion is the hash an imgid is a checksum with.
+type idVersion uint8
+
+const (
+	// images pinned before lasagnad switched to sha256 have md5 ids. md5
+	// collisions are trivial to make, so nothing new gets an md5 id, but old
+	// ones stick around until `lasagnad migrate-ids` replaces them.
+	idMD5 idVersion = iota + 1
+	idSHA256
+)
+
+// the number of bytes in an id with this version.
+func (v idVersion) size() int {
+	switch v {
+	case idMD5:
+		return md5.Size
+	case idSHA256:
+		return sha256.Size
+	default:
+		return 0
+	}
+}
+
+// an imgid is a checksum of an image's bytes. it's used to identify the image
+// in keys and urls, where it's hex encoded. the hex encoding doesn't say which
+// hash an id came from, but the length does: md5 ids are 32 characters long
+// and sha256 ids are 64.
+//
+// imgids are comparable, so they're fine to use as map keys.
+type imgid struct {
+	Version idVersion
+	sum     [sha256.Size]byte
+}
+
+// the id for an image's bytes.
+func newImgid(bs []byte) imgid {
+	return imgid{Version: idSHA256, sum: sha256.Sum256(bs)}
+}
+
+// the id an image's bytes would have had before sha256 ids. only useful for
+// checking old images.
+func md5Imgid(bs []byte) imgid {
+	sum := md5.Sum(bs)
+	id := imgid{Version: idMD5}
+	copy(id.sum[:], sum[:])
+	return id
+}
+
+// the hex encoded id.
+func (id imgid) String() string {
+	return hex.EncodeToString(id.sum[:id.Version.size()])
+}
+
+// parse a hex encoded imgid of any version.
+func imgidFromString(str string) (imgid, error) {
+	bs, err := hex.DecodeString(str)
+	if err != nil {
+		return imgid{}, err
+	}
+
+	for _, version := range []idVersion{idMD5, idSHA256} {
+		if len(bs) == version.size() {
+			id := imgid{Version: version}
+			copy(id.sum[:], bs)
+			return id, nil
+		}
+	}
+	return imgid{}, fmt.Errorf("imgid is the wrong length: %d bytes", len(bs))
+}
+
+// a migratedID is an image that migrate-ids gave a new id.
+type migratedID struct {
+	Name string
+	From imgid
+	To   imgid
+}
+
+// an idMigrator is an imageStore that can replace old md5 image ids.
+type idMigrator interface {
+	// give every image with an md5 id a sha256 id, keeping its name, metadata
+	// and tags, and return every image that got one. the old images are left
+	// where they are so that urls already posted to slack keep working, but
+	// they're marked as migrated and aren't listed anymore. running it twice is
+	// fine.
+	migrateIDs(ctx context.Context) ([]migratedID, error)
+}
+
+// the suffix of the marker left next to an image once it has a new id.
+const migratedSuffix = ".migrated"
+
+// the key for the marker that says the image at key has been given a new id.
+// it's hidden, like localdump's metadata files, so it's never listed as an
+// image.
+func migratedKey(key string) string {
+	return path.Join(path.Dir(key), "."+path.Base(key)+migratedSuffix)
+}
+
+// pick the images out of the keys listed in a single name's directory. hidden
+// keys aren't images, and neither are images that have been migrated to a new
+// id.
+func imageKeys(keys []string) map[string]bool {
+	images := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(path.Base(key), ".") {
+			images[key] = true
+		}
+	}
+	for _, key := range keys {
+		base := path.Base(key)
+		if strings.HasPrefix(base, ".") && strings.HasSuffix(base, migratedSuffix) {
+			delete(images, path.Join(path.Dir(key), strings.TrimSuffix(base[1:], migratedSuffix)))
+		}
+	}
+	return images
+}
+
+// give every md5 image in a store a sha256 id. stores handle reading an old
+// image's bytes and marking it as migrated, and everything else goes through
+// the imageStore like any other pin.
+func migrateStoreIDs(ctx context.Context, store imageStore, read func(context.Context, *img) ([]byte, error), markMigrated func(context.Context, *img) error) ([]migratedID, error) {
+	names, err := store.names(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []migratedID
+	for _, name := range names {
+		imgs, err := store.list(ctx, name.Name)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, listed := range imgs {
+			if listed.ID.Version != idMD5 {
+				continue
+			}
+
+			original, err := store.get(ctx, listed.Name, listed.ID)
+			if err != nil {
+				return migrated, err
+			}
+			bs, err := read(ctx, original)
+			if err != nil {
+				return migrated, errors.Wrap(err, "reading image failed")
+			}
+			if md5Imgid(bs) != original.ID {
+				return migrated, fmt.Errorf("imgdump: %s %s doesn't match its id", original.Name, original.ID)
+			}
+
+			metadata := make(map[string]*string, len(original.Metadata))
+			for k, v := range original.Metadata {
+				v := v
+				metadata[k] = &v
+			}
+			added, err := store.add(ctx, original.Name, original.Filetype, bs, metadata)
+			if err != nil {
+				return migrated, err
+			}
+			if len(original.Tags) > 0 {
+				if _, err := store.tag(ctx, added.Name, added.ID, original.Tags); err != nil {
+					return migrated, err
+				}
+			}
+
+			if err := markMigrated(ctx, original); err != nil {
+				return migrated, errors.Wrap(err, "marking image as migrated failed")
+			}
+			migrated = append(migrated, migratedID{Name: original.Name, From: original.ID, To: added.ID})
+		}
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImgidFromString(t *testing.T) {
+	for _, id := range []imgid{newImgid([]byte("garf")), md5Imgid([]byte("garf"))} {
+		parsed, err := imgidFromString(id.String())
+		require.NoError(t, err)
+		assert.Equal(t, id, parsed)
+	}
+
+	assert.Len(t, newImgid([]byte("garf")).String(), 64)
+	assert.Len(t, md5Imgid([]byte("garf")).String(), 32)
+	assert.NotEqual(t, newImgid([]byte("garf")), md5Imgid([]byte("garf")))
+
+	for _, str := range []string{"", "garf", "7287194d", strings.Repeat("a", 48), strings.Repeat("a", 66)} {
+		_, err := imgidFromString(str)
+		assert.Error(t, err, "%q: shouldn't parse", str)
+	}
+}
+
+func TestImageKeys(t *testing.T) {
+	md5 := md5Imgid([]byte("old")).String()
+	sha := newImgid([]byte("old")).String()
+
+	images := imageKeys([]string{
+		"lasagna/garf/." + md5 + ".gif.migrated",
+		"lasagna/garf/." + sha + ".gif.json",
+		"lasagna/garf/" + md5 + ".gif",
+		"lasagna/garf/" + sha + ".gif",
+	})
+	assert.Equal(t, map[string]bool{"lasagna/garf/" + sha + ".gif": true}, images)
+}
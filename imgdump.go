@@ -3,8 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"image"
 	"io"
@@ -12,12 +11,18 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	_ "image/gif"
 	_ "image/jpeg"
@@ -40,26 +45,50 @@ var (
 	// fetch request isn't a 200.
 	ErrBadResponseCode = fmt.Errorf("image: bad response code")
 
+	// ErrTooManyPixels is returned from fetchImageBytes when an image is too
+	// wide, too tall, or has too many pixels.
+	ErrTooManyPixels = fmt.Errorf("image: too many pixels")
+
 	// ErrBadImage is returned from fetchImageBytes when the content of the
 	// response can't be decoded as an image.
 	ErrBadImage = fmt.Errorf("image: bad image")
+
+	// ErrNotFound is returned from an imageStore when an image with the given
+	// name and id doesn't exist.
+	ErrNotFound = fmt.Errorf("imgdump: image not found")
 )
 
 // fetch the image at the given URL. runs the image through image.Decode to make
 // sure it's a valid image and returns ErrBadImage if it's not recognized.
 //
-// also limits the size of the images fetched. returns ErrTooLarge if the image
-func fetchImageBytes(ctx context.Context, client *http.Client, url *url.URL, sizeLimit int64) ([]byte, string, error) {
+// also limits the size of the images fetched. returns a *sizeError caused by
+// ErrTooLarge if the image is over limits.Bytes bytes, whether or not the server
+// sent a Content-Length, and an error caused by ErrTooManyPixels if the image's
+// dimensions are over the limits.
+func fetchImageBytes(ctx context.Context, client *http.Client, url *url.URL, limits imageLimits) ([]byte, string, error) {
+	return fetchImage(ctx, client, url, nil, limits)
+}
+
+// fetchImageBytes, but with extra headers on the request.
+func fetchImage(ctx context.Context, client *http.Client, url *url.URL, header http.Header, limits imageLimits) ([]byte, string, error) {
+	sizeLimit := limits.Bytes
+
 	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
 	if err != nil {
 		return nil, "", errors.Wrap(err, "image: bad http request")
 	}
 
 	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
 	req.Header.Set(userAgentHeader, userAgent)
 	req.Header.Set(acceptHeader, "image/*")
 
 	resp, err := client.Do(req)
+	if isForbidden(err) {
+		return nil, "", ErrForbiddenURL
+	}
 	if err != nil {
 		return nil, "", errors.Wrap(err, "image: http request failed")
 	}
@@ -69,58 +98,213 @@ func fetchImageBytes(ctx context.Context, client *http.Client, url *url.URL, siz
 		return nil, "", ErrBadResponseCode
 	}
 
-	if contentLengthTooLarge(resp, sizeLimit) {
-		return nil, "", ErrTooLarge
+	defer resp.Body.Close()
+	if contentLength, ok := parseContentLength(resp); ok && contentLength > sizeLimit {
+		return nil, "", &sizeError{Size: contentLength, Limit: sizeLimit}
 	}
 
-	defer resp.Body.Close()
-	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, sizeLimit))
+	// Content-Length can be missing or lie, so read one byte past the limit to
+	// tell whether the body is too big instead of silently truncating it.
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, sizeLimit+1))
 	if err != nil {
 		return nil, "", errors.Wrap(err, "image: reading data failed")
 	}
+	if int64(len(bs)) > sizeLimit {
+		return nil, "", &sizeError{Size: int64(len(bs)), Limit: sizeLimit, Truncated: true}
+	}
 
-	// try to decode the bytes as an image. this check could only sniff the image
-	// type but that wouldn't catch cases where there's mangled bytes at the end
-	// of the data. if that doesn't happen often and this is slow, maybe switch to
-	// image.DecodeConfig instead of image.Decode
-	_, filetype, err := image.Decode(bytes.NewReader(bs))
+	filetype, err := decodeImage(bs, limits)
 	if err != nil {
-		return nil, "", ErrBadImage
+		return nil, "", err
 	}
 
 	return bs, filetype, nil
 }
 
-func contentLengthTooLarge(r *http.Response, limit int64) bool {
+// limits on the images lasagnad is willing to fetch. Bytes limits the size of
+// the encoded image, and the rest limit the size of the decoded image.
+type imageLimits struct {
+	Bytes  int64
+	Width  int
+	Height int
+	Pixels int64
+}
+
+// decode bs as an image and return its filetype, but only after checking that
+// decoding it won't take a huge amount of memory. the dimensions in an image's
+// header are cheap to read, but a tiny PNG can claim to be 50000x50000 and
+// image.Decode will happily allocate gigabytes to hold it.
+//
+// returns ErrBadImage if the bytes aren't an image and an error caused by
+// ErrTooManyPixels if the image is too large.
+func decodeImage(bs []byte, limits imageLimits) (string, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(bs))
+	if err != nil {
+		return "", ErrBadImage
+	}
+	if err := limits.checkDimensions(config.Width, config.Height); err != nil {
+		return "", err
+	}
+
+	// decode the whole image even though the header checked out. this check could
+	// only sniff the image type but that wouldn't catch cases where there's
+	// mangled bytes at the end of the data.
+	_, filetype, err := image.Decode(bytes.NewReader(bs))
+	if err != nil {
+		return "", ErrBadImage
+	}
+
+	return filetype, nil
+}
+
+func (l imageLimits) checkDimensions(width, height int) error {
+	if width > l.Width || height > l.Height || int64(width)*int64(height) > l.Pixels {
+		return errors.Wrapf(ErrTooManyPixels, "%dx%d", width, height)
+	}
+	return nil
+}
+
+func parseContentLength(r *http.Response) (int64, bool) {
 	headerValue := r.Header.Get(contentLengthHeader)
 	if headerValue == "" {
-		return false
+		return 0, false
 	}
 
 	contentLength, err := strconv.ParseInt(headerValue, 10, 64)
 	if err != nil {
-		return false
+		return 0, false
+	}
+
+	return contentLength, true
+}
+
+// a sizeError is returned from fetchImageBytes when an image is too large. its
+// Cause is always ErrTooLarge.
+//
+// Size is the size of the image as far as lasagnad could tell. if Truncated is
+// set, the image didn't come with a Content-Length and lasagnad stopped reading
+// after Size bytes, so the real size is at least that big.
+type sizeError struct {
+	Size      int64
+	Limit     int64
+	Truncated bool
+}
+
+func (e *sizeError) Error() string {
+	atLeast := ""
+	if e.Truncated {
+		atLeast = "at least "
 	}
+	return fmt.Sprintf("%s: %s%d bytes, limit is %d bytes", ErrTooLarge, atLeast, e.Size, e.Limit)
+}
 
-	return contentLength > limit
+func (e *sizeError) Cause() error {
+	return ErrTooLarge
 }
 
-// an imgid is the md5 checksum of an images bytes. it's used to identify the
-// image in s3 and urls.
-type imgid = [md5.Size]byte
+// format a number of bytes for humans, like 10MB or 1.5KB.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	value, suffix := float64(n)/unit, "KB"
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+
+	formatted := strings.TrimSuffix(strconv.FormatFloat(value, 'f', 1, 64), ".0")
+	return formatted + suffix
+}
 
 // an img is an image that's been uploaded to storage. it's already been
 // digested and has an id, a filetype, and a url.
+//
+// Size, CreatedAt, Metadata and Tags are only filled in when an img is looked
+// up directly with get.
 type img struct {
 	Name     string
 	ID       imgid
 	Filetype string
 	URL      *url.URL
+
+	Size      int64
+	CreatedAt time.Time
+	Metadata  map[string]string
+	Tags      []string
+
+	// true for images pinned before blobs existed, which still have their bytes
+	// under their name instead of in a blob. see blobs.go
+	Legacy bool
+}
+
+// a nameCount is a pin name and the number of images pinned under it.
+type nameCount struct {
+	Name  string
+	Count int
+}
+
+// an imageStore is somewhere to put pinned images. images are stored with a
+// name and are identified by their imgid, and every store has to be able to
+// hand back a URL that slack can unfurl.
+//
+// imgdump is the S3 backed imageStore and localdump keeps images on the local
+// filesystem. both use the same key layout.
+type imageStore interface {
+	// add an image to the store and return it. metadata is stored alongside the
+	// image and is returned by get.
+	add(ctx context.Context, name, filetype string, bs []byte, metadata map[string]*string) (*img, error)
+
+	// list all of the images with the given name.
+	list(ctx context.Context, name string) ([]img, error)
+
+	// list every name that has images, along with how many images it has.
+	// names are sorted.
+	names(ctx context.Context) ([]nameCount, error)
+
+	// get a single image and its metadata. returns ErrNotFound if there's no
+	// image with that name and id.
+	get(ctx context.Context, name string, id imgid) (*img, error)
+
+	// delete a single image. returns ErrNotFound if there's no image with that
+	// name and id.
+	delete(ctx context.Context, name string, id imgid) error
+
+	// copy a single image and its metadata from one name to another and return
+	// the copy. returns ErrNotFound if there's no image with the from name and
+	// id. copying over an image that's already there is fine.
+	copy(ctx context.Context, from, to string, id imgid) (*img, error)
+
+	// add tags to an image and return all of its tags, sorted. returns
+	// ErrTooManyTags if the image would end up with more than maxTagsPerImage.
+	tag(ctx context.Context, name string, id imgid, tags []string) ([]string, error)
+
+	// list every image with the given tag, under any name.
+	tagged(ctx context.Context, tag string) ([]img, error)
+
+	// the url for an image. this doesn't check that the image exists.
+	imgURL(name, filetype string, id imgid) *url.URL
+
+	// the url for an image pinned before blobs existed. like imgURL, this
+	// doesn't check that the image exists.
+	legacyURL(name, filetype string, id imgid) *url.URL
+
+	// load the alias map. returns an empty map if nothing has ever been aliased.
+	aliases(ctx context.Context) (map[string]string, error)
+
+	// replace the alias map.
+	saveAliases(ctx context.Context, aliases map[string]string) error
 }
 
 // an imgdump is a bunch of images stored in an s3 bucket. images are given a
 // name to look them up by later, but multiple images may have the same name -
-// they're uniquely identified by the MD5 of their content.
+// they're uniquely identified by the SHA-256 of their content (see ids.go).
+// the same image can be pinned under lots of names, but its bytes are only
+// stored once. see blobs.go
 //
 // given that, an imgdump needs a name and an ID to look up an image directly.
 // when looking up images by name, the best an imgdump can do is list all of the
@@ -128,142 +312,857 @@ type img struct {
 //
 // images are stored under some prefix so as not to pollute the bucket used.
 //
-// the S3 URL for an image is constructed as follows:
+// the S3 URL for an image's reference is constructed as follows:
 //
-//		s3://bucket/<prefix>/<name1>/<image_md5>.<filetype>
+//		s3://bucket/<prefix>/<name1>/<image_sha256>.<filetype>
 //
 // an s3 bucket with a few images already in it might look like:
 //
-//    s3://some-bucket/once/told/me/wizard/7a1030242704ebe5c0fad16d9f56d785.jpg
-//    s3://some-bucket/once/told/me/wizard/d769203fb5cd47d1f2b82e56028f3d45.png
-//    s3://some-bucket/once/told/me/garf/f4369905865d32042ddc3c025d45eb50.png
+//    s3://some-bucket/once/told/me/blobs/ab859158947e9470284bf5d9da9468bc93f050d78be8308a1b08830b10737059.jpg
+//    s3://some-bucket/once/told/me/blobs/ab859158947e9470284bf5d9da9468bc93f050d78be8308a1b08830b10737059/garf
+//    s3://some-bucket/once/told/me/blobs/ab859158947e9470284bf5d9da9468bc93f050d78be8308a1b08830b10737059/wizard
+//    s3://some-bucket/once/told/me/wizard/ab859158947e9470284bf5d9da9468bc93f050d78be8308a1b08830b10737059.jpg
+//    s3://some-bucket/once/told/me/garf/ab859158947e9470284bf5d9da9468bc93f050d78be8308a1b08830b10737059.jpg
 //
 type imgdump struct {
 	Bucket string
 	Prefix string
 	S3     *s3.S3
+
+	// how urls for images are handed out, and how long presigned urls last. an
+	// empty URLMode means urlModePublic. see s3urls.go
+	URLMode     string
+	URLLifetime time.Duration
+
+	// the base url for urlModeCDN
+	BaseURL *url.URL
+
+	// the canned ACL blobs are uploaded with. empty means no ACL at all, which
+	// is what a bucket that blocks public ACLs needs.
+	ACL string
+
+	// where to complain about keys that can't be read. defaults to logrus's
+	// standard logger.
+	Logger logrus.FieldLogger
 }
 
-// add an image to the dump. this will overwrite an existing key if and only if
-// the image bytes, filetype, and the name are identical.
+// add an image to the dump. the image's blob is only uploaded if it isn't
+// there already, but the reference to it is always written, so this overwrites
+// an existing image's metadata and tags if and only if the image bytes,
+// filetype, and the name are identical.
 func (dump *imgdump) add(ctx context.Context, name, filetype string, bs []byte, metadata map[string]*string) (*img, error) {
-	imgid := md5.Sum(bs)
+	if !validPinName(name) {
+		return nil, ErrInvalidPinName
+	}
+
+	imgid := newImgid(bs)
 	key := s3key(dump.Prefix, name, filetype, imgid)
+	blob := blobKey(dump.Prefix, filetype, imgid)
 	// NOTE(benl): filetype should be generated by image.Decode so we're going to
 	// assume that image/filetype is a valid mime type. even if it's not, maybe
 	// just image/whatever is ok?
 	mimeType := fmt.Sprintf("image/%s", filetype)
 
-	_, err := dump.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:      &dump.Bucket,
-		Key:         &key,
-		Body:        bytes.NewReader(bs),
-		ACL:         aws.String("public-read"),
-		ContentType: &mimeType,
-		Metadata:    metadata,
-	})
+	if err := dump.putEmpty(ctx, blobRefKey(dump.Prefix, name, imgid), nil, ""); err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
 
+	exists, err := dump.exists(ctx, blob)
 	if err != nil {
 		return nil, errors.Wrap(err, "upload failed")
 	}
+	if !exists {
+		startedAt := time.Now()
+		_, err = dump.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      &dump.Bucket,
+			Key:         &blob,
+			Body:        bytes.NewReader(bs),
+			ACL:         dump.objectACL(),
+			ContentType: &mimeType,
+		})
+		observeS3("put", startedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload failed")
+		}
+	}
+	blobWritesTotal.WithLabelValues(blobWriteResult(!exists)).Inc()
+
+	if err := dump.putEmpty(ctx, key, metadata, ""); err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
 
 	return &img{
 		Name:     name,
 		ID:       imgid,
 		Filetype: filetype,
-		URL:      s3url(dump.Bucket, dump.Prefix, name, filetype, imgid),
+		URL:      dump.imgURL(name, filetype, imgid),
 	}, nil
 }
 
 // list all images with the given name.
 func (dump *imgdump) list(ctx context.Context, name string) ([]img, error) {
+	if !validPinName(name) {
+		return nil, ErrInvalidPinName
+	}
+
 	// NOTE(benl): this buffers everything into memory. there are probably only
 	// ever going to be at most a few hundred of these, so that is A-OK for now.
 	// if that changes, revisit this!
-	prefix := s3prefix(dump.Prefix, name)
+	//
+	// list with a delimiter so that listing garf doesn't include garfield, or
+	// anything in the garf/ namespace.
+	objects, _, err := dump.listDir(ctx, s3prefix(dump.Prefix, name)+"/")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing images failed")
+	}
+	objects = imageObjects(objects)
 
-	var imgs []img
+	imgs := make([]img, 0, len(objects))
+	for _, obj := range objects {
+		key := aws.StringValue(obj.Key)
+		imgid, filetype, err := idAndFiletype(key)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+		}
+		imgs = append(imgs, img{
+			Name:     name,
+			ID:       imgid,
+			Filetype: filetype,
+			URL:      dump.objectURL(key, aws.Int64Value(obj.Size)),
+			Legacy:   aws.Int64Value(obj.Size) > 0,
+		})
+	}
+
+	return imgs, nil
+}
+
+// list every name in the dump and count its images.
+func (dump *imgdump) names(ctx context.Context) ([]nameCount, error) {
+	dirs, err := dump.nameDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNameDirs(storeLogger(dump.Logger), dirs), nil
+}
+
+// list every directory in the dump that has images in it.
+//
+// names are the "directories" under the prefix, so they're listed with a
+// delimiter instead of walking every key in the bucket. a directory can hold
+// images, namespaced names, or both, so every directory gets listed once and
+// only directories that have images in them count as names.
+func (dump *imgdump) nameDirs(ctx context.Context) ([]nameDir, error) {
+	root := dump.Prefix + "/"
+
+	var dirs []nameDir
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		objects, subdirs, err := dump.listDir(ctx, dir)
+		if err != nil {
+			return err
+		}
+		objects = imageObjects(objects)
+
+		if depth > 0 && len(objects) > 0 {
+			dirs = append(dirs, nameDir{
+				Dir:   strings.TrimSuffix(strings.TrimPrefix(dir, root), "/"),
+				Count: len(objects),
+			})
+		}
+
+		if depth < maxPinNameSegments {
+			for _, subdir := range subdirs {
+				// there's a whole lot of nothing but blobs in there
+				if subdir == root+blobsDir+"/" {
+					continue
+				}
+				if err := walk(subdir, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(root, 0); err != nil {
+		return nil, errors.Wrap(err, "listing names failed")
+	}
+	return dirs, nil
+}
+
+// list the objects and the common prefixes directly under a prefix, using / as
+// a delimiter. prefix should end with a /
+func (dump *imgdump) listDir(ctx context.Context, prefix string) (objects []*s3.Object, prefixes []string, err error) {
 	var marker string
 
 	for {
 		request := &s3.ListObjectsInput{
-			Bucket: &dump.Bucket,
-			Prefix: &prefix,
+			Bucket:    &dump.Bucket,
+			Prefix:    &prefix,
+			Delimiter: aws.String("/"),
 		}
 		if marker != "" {
 			request.Marker = &marker
 		}
 
-		// NOTE: the S3 client (probably?) checks the context for timeouts and
-		// cancellation before sending a request, so it doesn't have to get checked
-		// manually elsewhere in this loop.
+		startedAt := time.Now()
 		resp, err := dump.S3.ListObjectsWithContext(ctx, request)
+		observeS3("list", startedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, resp.Contents...)
+		for _, p := range resp.CommonPrefixes {
+			prefixes = append(prefixes, *p.Prefix)
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+
+		// NextMarker is only returned when there's a delimiter in the request,
+		// which there always is here. it's the last key OR common prefix in the
+		// response, which means it's the only safe way to continue.
+		marker = aws.StringValue(resp.NextMarker)
+		if marker == "" {
+			return nil, nil, fmt.Errorf("imgdump: truncated listing without a marker")
+		}
+	}
+
+	return objects, prefixes, nil
+}
+
+// the objects in a listing of a single name's directory that are images. see
+// imageKeys.
+func imageObjects(objects []*s3.Object) []*s3.Object {
+	keys := make([]string, len(objects))
+	for i, obj := range objects {
+		keys[i] = aws.StringValue(obj.Key)
+	}
+	images := imageKeys(keys)
+
+	filtered := make([]*s3.Object, 0, len(images))
+	for _, obj := range objects {
+		if images[aws.StringValue(obj.Key)] {
+			filtered = append(filtered, obj)
+		}
+	}
+	return filtered
+}
+
+// get a single image and all of its metadata. the metadata is on the reference,
+// but the size is the size of the blob.
+func (dump *imgdump) get(ctx context.Context, name string, id imgid) (*img, error) {
+	key, size, err := dump.find(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dump.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &dump.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching image metadata failed")
+	}
+
+	_, filetype, err := idAndFiletype(key)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+	}
+
+	legacy := size > 0
+	if !legacy {
+		blob, err := dump.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &dump.Bucket,
+			Key:    aws.String(blobKey(dump.Prefix, filetype, id)),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching image blob failed")
+		}
+		size = aws.Int64Value(blob.ContentLength)
+	}
+
+	tags, err := dump.objectTags(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 hands metadata back with its keys in canonical header form, so
+	// uploaded-by comes back as Uploaded-By. lowercase everything so that keys
+	// match what was passed to add.
+	metadata := make(map[string]string, len(resp.Metadata))
+	for k, v := range resp.Metadata {
+		if v != nil {
+			metadata[strings.ToLower(k)] = *v
+		}
+	}
+
+	return &img{
+		Name:      name,
+		ID:        id,
+		Filetype:  filetype,
+		URL:       dump.objectURL(key, aws.Int64Value(resp.ContentLength)),
+		Size:      size,
+		CreatedAt: aws.TimeValue(resp.LastModified),
+		Metadata:  metadata,
+		Tags:      tags,
+		Legacy:    legacy,
+	}, nil
+}
+
+// delete a single image, and its blob if nothing else refers to it.
+func (dump *imgdump) delete(ctx context.Context, name string, id imgid) error {
+	key, _, err := dump.find(ctx, name, id)
+	if err != nil {
+		return err
+	}
+	_, filetype, err := idAndFiletype(key)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+	}
+
+	for _, k := range []string{key, blobRefKey(dump.Prefix, name, id)} {
+		if err := dump.deleteKey(ctx, k); err != nil {
+			return errors.Wrap(err, "deleting image failed")
+		}
+	}
+
+	return dump.collectBlob(ctx, filetype, id)
+}
+
+// delete a blob if nothing refers to it anymore.
+func (dump *imgdump) collectBlob(ctx context.Context, filetype string, id imgid) error {
+	startedAt := time.Now()
+	resp, err := dump.S3.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+		Bucket:  &dump.Bucket,
+		Prefix:  aws.String(blobRefsPrefix(dump.Prefix, id)),
+		MaxKeys: aws.Int64(1),
+	})
+	observeS3("list", startedAt)
+	if err != nil {
+		return errors.Wrap(err, "checking blob references failed")
+	}
+	if len(resp.Contents) > 0 {
+		return nil
+	}
+
+	if err := dump.deleteKey(ctx, blobKey(dump.Prefix, filetype, id)); err != nil {
+		return errors.Wrap(err, "deleting blob failed")
+	}
+	blobsCollectedTotal.Inc()
+	return nil
+}
+
+// delete a key. deleting a key that doesn't exist isn't an error.
+func (dump *imgdump) deleteKey(ctx context.Context, key string) error {
+	startedAt := time.Now()
+	_, err := dump.S3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &dump.Bucket,
+		Key:    &key,
+	})
+	observeS3("delete", startedAt)
+	return err
+}
+
+// write an empty, private object. tagging is a URL encoded tag set.
+func (dump *imgdump) putEmpty(ctx context.Context, key string, metadata map[string]*string, tagging string) error {
+	input := &s3.PutObjectInput{
+		Bucket:   &dump.Bucket,
+		Key:      &key,
+		Body:     bytes.NewReader(nil),
+		Metadata: metadata,
+	}
+	if tagging != "" {
+		input.Tagging = &tagging
+	}
+
+	startedAt := time.Now()
+	_, err := dump.S3.PutObjectWithContext(ctx, input)
+	observeS3("put", startedAt)
+	return err
+}
+
+// true if there's an object at key.
+func (dump *imgdump) exists(ctx context.Context, key string) (bool, error) {
+	startedAt := time.Now()
+	_, err := dump.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &dump.Bucket,
+		Key:    &key,
+	})
+	observeS3("head", startedAt)
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// make sure an image pinned before blobs existed has a blob, by copying the
+// old image into place.
+func (dump *imgdump) ensureBlob(ctx context.Context, key, filetype string, id imgid) error {
+	blob := blobKey(dump.Prefix, filetype, id)
+	exists, err := dump.exists(ctx, blob)
+	if err != nil || exists {
+		return err
+	}
+
+	// CopySource has to be URL encoded, and encoded names have a % in them
+	source := (&url.URL{Path: dump.Bucket + "/" + key}).EscapedPath()
+
+	startedAt := time.Now()
+	_, err = dump.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            &dump.Bucket,
+		Key:               &blob,
+		CopySource:        &source,
+		ACL:               dump.objectACL(),
+		ContentType:       aws.String("image/" + filetype),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		TaggingDirective:  aws.String(s3.TaggingDirectiveReplace),
+	})
+	observeS3("copy", startedAt)
+	return err
+}
+
+// copy an image to another name. only the reference gets copied, and S3 does
+// the copying, so the reference's metadata and tags come with it. copying an
+// image pinned before blobs existed makes a blob for it.
+func (dump *imgdump) copy(ctx context.Context, from, to string, id imgid) (*img, error) {
+	if !validPinName(to) {
+		return nil, ErrInvalidPinName
+	}
+
+	key, size, err := dump.find(ctx, from, id)
+	if err != nil {
+		return nil, err
+	}
+	return dump.copyKey(ctx, key, size, to, id)
+}
+
+// copy the image at key to another name. size is the size of the object at
+// key, which is only zero if it's a reference to a blob.
+func (dump *imgdump) copyKey(ctx context.Context, key string, size int64, to string, id imgid) (*img, error) {
+	_, filetype, err := idAndFiletype(key)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+	}
+
+	if err := dump.putEmpty(ctx, blobRefKey(dump.Prefix, to, id), nil, ""); err != nil {
+		return nil, errors.Wrap(err, "copying image failed")
+	}
+
+	dest := s3key(dump.Prefix, to, filetype, id)
+	if size > 0 {
+		if err := dump.copyLegacy(ctx, key, dest, filetype, id); err != nil {
+			return nil, errors.Wrap(err, "copying image failed")
+		}
+	} else {
+		// CopySource has to be URL encoded, and encoded names have a % in them
+		source := (&url.URL{Path: dump.Bucket + "/" + key}).EscapedPath()
+
+		startedAt := time.Now()
+		_, err = dump.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:            &dump.Bucket,
+			Key:               &dest,
+			CopySource:        &source,
+			MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		})
+		observeS3("copy", startedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "copying image failed")
+		}
+	}
+
+	return &img{
+		Name:     to,
+		ID:       id,
+		Filetype: filetype,
+		URL:      dump.imgURL(to, filetype, id),
+	}, nil
+}
+
+// copy an image pinned before blobs existed to a new reference, making a blob
+// for it if it doesn't have one.
+func (dump *imgdump) copyLegacy(ctx context.Context, key, dest, filetype string, id imgid) error {
+	if err := dump.ensureBlob(ctx, key, filetype, id); err != nil {
+		return err
+	}
+
+	resp, err := dump.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &dump.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	tags, err := dump.objectTags(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	tagging := url.Values{}
+	for _, tag := range tags {
+		tagging.Set(tag, "")
+	}
+	return dump.putEmpty(ctx, dest, resp.Metadata, tagging.Encode())
+}
+
+// make blobs and reference markers for every image pinned before blobs
+// existed. the old images are left where they are, since slack has links to
+// them all over the place.
+func (dump *imgdump) migrateBlobs(ctx context.Context) (int, error) {
+	names, err := dump.names(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, name := range names {
+		objects, _, err := dump.listDir(ctx, s3prefix(dump.Prefix, name.Name)+"/")
+		if err != nil {
+			return migrated, errors.Wrap(err, "listing images failed")
+		}
+
+		for _, obj := range imageObjects(objects) {
+			key := aws.StringValue(obj.Key)
+			if aws.Int64Value(obj.Size) == 0 {
+				continue
+			}
+			id, filetype, err := idAndFiletype(key)
+			if err != nil {
+				return migrated, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+			}
+
+			if err := dump.putEmpty(ctx, blobRefKey(dump.Prefix, name.Name, id), nil, ""); err != nil {
+				return migrated, errors.Wrap(err, "migrating image failed")
+			}
+			if err := dump.ensureBlob(ctx, key, filetype, id); err != nil {
+				return migrated, errors.Wrap(err, "migrating image failed")
+			}
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// give every image with an md5 id a new id. see idMigrator.
+func (dump *imgdump) migrateIDs(ctx context.Context) ([]migratedID, error) {
+	read := func(ctx context.Context, img *img) ([]byte, error) {
+		key, size, err := dump.find(ctx, img.Name, img.ID)
+		if err != nil {
+			return nil, err
+		}
+		// a zero-size object is a reference, and the bytes live in the blob
+		if size == 0 {
+			key = blobKey(dump.Prefix, img.Filetype, img.ID)
+		}
+
+		startedAt := time.Now()
+		resp, err := dump.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: &dump.Bucket,
+			Key:    &key,
+		})
+		observeS3("get", startedAt)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+	markMigrated := func(ctx context.Context, img *img) error {
+		key, _, err := dump.find(ctx, img.Name, img.ID)
+		if err != nil {
+			return err
+		}
+		return dump.putEmpty(ctx, migratedKey(key), nil, "")
+	}
+	return migrateStoreIDs(ctx, dump, read, markMigrated)
+}
+
+// copy every image under a name that isn't normalized to the name it
+// normalizes to. see nameMigrator.
+func (dump *imgdump) migrateNames(ctx context.Context) ([]renamedPin, error) {
+	dirs, err := dump.nameDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rename := func(ctx context.Context, dir, to string) ([]imgid, error) {
+		objects, _, err := dump.listDir(ctx, path.Join(dump.Prefix, dir)+"/")
 		if err != nil {
 			return nil, errors.Wrap(err, "listing images failed")
 		}
 
-		for _, obj := range resp.Contents {
-			imgid, filetype, err := idAndFiletype(*obj.Key)
+		var ids []imgid
+		for _, obj := range imageObjects(objects) {
+			key := aws.StringValue(obj.Key)
+			id, _, err := idAndFiletype(key)
 			if err != nil {
-				return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", *obj.Key))
+				return ids, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
 			}
-			imgs = append(imgs, img{
-				Name:     name,
-				ID:       imgid,
-				Filetype: filetype,
-				URL:      s3url(dump.Bucket, dump.Prefix, name, filetype, imgid),
-			})
+			if _, err := dump.copyKey(ctx, key, aws.Int64Value(obj.Size), to, id); err != nil {
+				return ids, err
+			}
+			if err := dump.putEmpty(ctx, migratedKey(key), nil, ""); err != nil {
+				return ids, errors.Wrap(err, "marking image as migrated failed")
+			}
+			ids = append(ids, id)
 		}
+		return ids, nil
+	}
+	return migrateStoreNames(ctx, storeLogger(dump.Logger), dirs, rename)
+}
 
-		if !*resp.IsTruncated {
-			break
+// add tags to an image. S3 replaces an object's whole tag set at once, so this
+// reads the existing tags first.
+func (dump *imgdump) tag(ctx context.Context, name string, id imgid, tags []string) ([]string, error) {
+	key, _, err := dump.find(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := dump.objectTags(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	merged := mergeTags(existing, tags)
+	if len(merged) > maxTagsPerImage {
+		return nil, ErrTooManyTags
+	}
+
+	tagSet := make([]*s3.Tag, len(merged))
+	for i, tag := range merged {
+		tagSet[i] = &s3.Tag{Key: aws.String(tag), Value: aws.String("")}
+	}
+
+	startedAt := time.Now()
+	_, err = dump.S3.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  &dump.Bucket,
+		Key:     &key,
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	observeS3("put_tagging", startedAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "tagging image failed")
+	}
+
+	return merged, nil
+}
+
+// list every image with a tag. S3 can't look objects up by their tags, so this
+// has to check the tags on every single image. it's slow, and meant for
+// running without an index.
+func (dump *imgdump) tagged(ctx context.Context, tag string) ([]img, error) {
+	names, err := dump.names(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []img
+	for _, name := range names {
+		imgs, err := dump.list(ctx, name.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, img := range imgs {
+			// find the image's key instead of building it, since the extension
+			// an old image was pinned with isn't always the one s3key would use.
+			key, _, err := dump.find(ctx, img.Name, img.ID)
+			if err != nil {
+				return nil, err
+			}
+			tags, err := dump.objectTags(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if hasTag(tags, tag) {
+				tagged = append(tagged, img)
+			}
 		}
-		marker = *resp.Contents[len(resp.Contents)-1].Key
 	}
 
-	return imgs, nil
+	return tagged, nil
 }
 
-// make an s3 key. should only be called from imgdump
-func s3key(prefix, name, filetype string, id imgid) string {
-	extensions, err := mime.ExtensionsByType("image/" + filetype)
+// the tags on an object, sorted.
+func (dump *imgdump) objectTags(ctx context.Context, key string) ([]string, error) {
+	startedAt := time.Now()
+	resp, err := dump.S3.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: &dump.Bucket,
+		Key:    &key,
+	})
+	observeS3("get_tagging", startedAt)
 	if err != nil {
-		panic(fmt.Sprintf("illegal image mime type %q! error=%q", filetype, err))
+		return nil, errors.Wrap(err, "fetching image tags failed")
 	}
-	if len(extensions) == 0 {
-		panic(fmt.Sprintf("unknown image mime type %q!", filetype))
+
+	var tags []string
+	for _, tag := range resp.TagSet {
+		tags = append(tags, aws.StringValue(tag.Key))
 	}
-	ext := extensions[0]
-	filename := fmt.Sprintf("%x%s", id, ext)
+	sort.Strings(tags)
+	return tags, nil
+}
 
-	return filepath.Join(prefix, name, filename)
+// the public url for an image. that's the url of its blob, even for images
+// pinned before blobs existed, so those need migrateBlobs.
+func (dump *imgdump) imgURL(name, filetype string, id imgid) *url.URL {
+	return dump.keyURL(blobKey(dump.Prefix, filetype, id))
 }
 
-// make an s3 prefix for listing a bucket. should only be called from imgdump
-func s3prefix(prefix, name string) string {
-	return filepath.Join(prefix, name)
+// the public url for an image pinned before blobs existed, which is the url of
+// the image under its name.
+func (dump *imgdump) legacyURL(name, filetype string, id imgid) *url.URL {
+	return dump.keyURL(s3key(dump.Prefix, name, filetype, id))
 }
 
-// make an s3 url. should only be called from imgdump
-func s3url(bucket, prefix, name, filetype string, id imgid) *url.URL {
-	extensions, err := mime.ExtensionsByType("image/" + filetype)
+// the public url for an image, given the key and size of its reference. empty
+// references point at a blob and anything else is an image pinned before blobs
+// existed.
+func (dump *imgdump) objectURL(key string, size int64) *url.URL {
+	if size > 0 {
+		return dump.keyURL(key)
+	}
+	id, filetype, _ := idAndFiletype(key)
+	return dump.imgURL("", filetype, id)
+}
+
+// load the alias map. see aliases.go
+func (dump *imgdump) aliases(ctx context.Context) (map[string]string, error) {
+	startedAt := time.Now()
+	resp, err := dump.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &dump.Bucket,
+		Key:    aws.String(aliasesKey(dump.Prefix)),
+	})
+	observeS3("get", startedAt)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return map[string]string{}, nil
+	}
 	if err != nil {
-		panic(fmt.Sprintf("illegal image mime type %q! error=%q", filetype, err))
+		return nil, errors.Wrap(err, "fetching aliases failed")
 	}
-	if len(extensions) == 0 {
-		panic(fmt.Sprintf("unknown image mime type %q!", filetype))
+	defer resp.Body.Close()
+
+	aliases := make(map[string]string)
+	if err := json.NewDecoder(resp.Body).Decode(&aliases); err != nil {
+		return nil, errors.Wrap(err, "decoding aliases failed")
 	}
-	ext := extensions[0]
+	return aliases, nil
+}
 
-	filename := fmt.Sprintf("%x%s", id, ext)
+// save the alias map. unlike images, the alias map isn't public.
+func (dump *imgdump) saveAliases(ctx context.Context, aliases map[string]string) error {
+	bs, err := json.Marshal(aliases)
+	if err != nil {
+		return errors.Wrap(err, "encoding aliases failed")
+	}
 
+	startedAt := time.Now()
+	_, err = dump.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      &dump.Bucket,
+		Key:         aws.String(aliasesKey(dump.Prefix)),
+		Body:        bytes.NewReader(bs),
+		ContentType: aws.String("application/json"),
+	})
+	observeS3("put", startedAt)
+	if err != nil {
+		return errors.Wrap(err, "saving aliases failed")
+	}
+	return nil
+}
+
+// find the full key for an image and its size. the id is the start of the
+// filename, but the extension depends on the filetype, so this has to list the
+// bucket with the id as a prefix.
+func (dump *imgdump) find(ctx context.Context, name string, id imgid) (string, int64, error) {
+	if !validPinName(name) {
+		return "", 0, ErrInvalidPinName
+	}
+
+	prefix := fmt.Sprintf("%s/%s.", s3prefix(dump.Prefix, name), id)
+
+	resp, err := dump.S3.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+		Bucket: &dump.Bucket,
+		Prefix: &prefix,
+	})
+	if err != nil {
+		return "", 0, errors.Wrap(err, "finding image failed")
+	}
+	if len(resp.Contents) == 0 {
+		return "", 0, ErrNotFound
+	}
+	key := aws.StringValue(resp.Contents[0].Key)
+
+	// md5 images that have been given a new id are only still around for the
+	// sake of old urls.
+	if id.Version == idMD5 {
+		migrated, err := dump.exists(ctx, migratedKey(key))
+		if err != nil {
+			return "", 0, errors.Wrap(err, "finding image failed")
+		}
+		if migrated {
+			return "", 0, ErrNotFound
+		}
+	}
+
+	return key, aws.Int64Value(resp.Contents[0].Size), nil
+}
+
+// make an s3 key. name has to be a valid pin name - stores check names with
+// validPinName before building keys out of them, so a name can't climb out of
+// the prefix. names are encoded with encodePinName.
+func s3key(prefix, name, filetype string, id imgid) string {
+	filename := id.String() + extension(filetype)
+	return path.Join(s3prefix(prefix, name), filename)
+}
+
+// make an s3 prefix for listing a bucket. like s3key, name has to be a valid
+// pin name.
+func s3prefix(prefix, name string) string {
+	return path.Join(prefix, encodePinName(name))
+}
+
+// make a plain us-east-1 s3 url for a key. imgdump.keyURL only uses this when
+// its client can't build a url itself.
+func s3keyURL(bucket, key string) *url.URL {
 	u := &url.URL{}
 	u.Scheme = "https"
 	u.Host = fmt.Sprintf("%s.s3.amazonaws.com", bucket)
-	u.Path = filepath.Join(prefix, name, filename)
+	u.Path = key
 	return u
 }
 
+// the preferred file extensions for the filetypes image.Decode knows about.
+// mime.ExtensionsByType returns extensions sorted alphabetically, which would
+// make every jpeg a .jfif
+var preferredExtensions = map[string]string{
+	"gif":  ".gif",
+	"jpeg": ".jpg",
+	"png":  ".png",
+}
+
+// get the file extension for an image filetype. panics if the filetype isn't
+// a known image mime type.
+func extension(filetype string) string {
+	if ext, ok := preferredExtensions[filetype]; ok {
+		return ext
+	}
+
+	extensions, err := mime.ExtensionsByType("image/" + filetype)
+	if err != nil {
+		panic(fmt.Sprintf("illegal image mime type %q! error=%q", filetype, err))
+	}
+	if len(extensions) == 0 {
+		panic(fmt.Sprintf("unknown image mime type %q!", filetype))
+	}
+	return extensions[0]
+}
+
 // parse an imgid and filetype from an s3key. assumes the key was constructed
 // by the s3key func
 func idAndFiletype(s3key string) (imgid, string, error) {
@@ -278,18 +1177,25 @@ func idAndFiletype(s3key string) (imgid, string, error) {
 
 	id, err := imgidFromString(filename[:len(filename)-len(ext)])
 	if err != nil {
-		return imgid{}, "", nil
+		return imgid{}, "", err
 	}
 
 	return id, filetype, nil
 }
 
-func imgidFromString(str string) (imgid, error) {
-	var id imgid
-	bs, err := hex.DecodeString(str)
-	if err != nil || len(bs) != md5.Size {
-		return id, err
+// the short form of an image id shown to users. it's a prefix of the hex
+// encoded id.
+func shortID(id imgid) string {
+	return id.String()[:8]
+}
+
+// find all of the images with an id that starts with the given hex prefix.
+func matchID(imgs []img, idPrefix string) []img {
+	var matches []img
+	for _, img := range imgs {
+		if strings.HasPrefix(img.ID.String(), idPrefix) {
+			matches = append(matches, img)
+		}
 	}
-	copy(id[:], bs)
-	return id, nil
+	return matches
 }
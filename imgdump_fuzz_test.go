@@ -0,0 +1,36 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fuzzing needs go 1.18. TestDecodeImageLimits covers the same images on older
+// toolchains.
+func FuzzDecodeImage(f *testing.F) {
+	f.Add(craftPNG(f, 16, 16, 16))
+	f.Add(craftPNG(f, 50000, 50000, 1))
+	f.Add(craftGIF(f, 16, 16))
+	f.Add(craftGIF(f, 65535, 65535))
+	f.Add(craftJPEG(f, 8, 8))
+	f.Add(craftJPEG(f, 65000, 65000))
+
+	f.Fuzz(func(t *testing.T, bs []byte) {
+		_, err := decodeImage(bs, testImageLimits)
+		if err != nil {
+			return
+		}
+
+		// anything that decoded has to have been inside the limits
+		config, _, err := image.DecodeConfig(bytes.NewReader(bs))
+		require.NoError(t, err)
+		assert.NoError(t, testImageLimits.checkDimensions(config.Width, config.Height))
+	})
+}
@@ -1,8 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -36,6 +63,13 @@ func TestS3Key(t *testing.T) {
 			id:       "7287194dfdb24cb741413ebb7f9b121d",
 			expected: "lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.png",
 		},
+		{
+			prefix:   "lasagna",
+			name:     "comics/mork",
+			filetype: "png",
+			id:       "7287194dfdb24cb741413ebb7f9b121d",
+			expected: "lasagna/comics/mork/7287194dfdb24cb741413ebb7f9b121d.png",
+		},
 	}
 
 	for _, tc := range tcs {
@@ -45,49 +79,88 @@ func TestS3Key(t *testing.T) {
 	}
 }
 
-func TestS3URL(t *testing.T) {
+// an s3 client that can build and sign urls but never talks to a real bucket.
+func testS3Client(t *testing.T, region string) *s3.S3 {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Credentials: credentials.NewStaticCredentials("AKIDGARF", "lasagna", ""),
+	})
+	require.NoError(t, err)
+	return s3.New(sess)
+}
+
+func TestImgdumpKeyURL(t *testing.T) {
+	cdn, err := url.Parse("https://cdn.example.com/images/")
+	require.NoError(t, err)
+
 	tcs := []struct {
-		bucket   string
-		prefix   string
-		name     string
-		filetype string
-		id       string
+		dump     *imgdump
+		key      string
 		expected string
 	}{
 		{
-			bucket:   "garf",
-			prefix:   "lasagna",
-			name:     "mork",
-			filetype: "jpeg",
-			id:       "7287194dfdb24cb741413ebb7f9b121d",
+			dump:     &imgdump{Bucket: "garf", S3: testS3Client(t, "us-east-1")},
+			key:      "lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.jpg",
 			expected: "https://garf.s3.amazonaws.com/lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.jpg",
 		},
 		{
-			bucket:   "garf",
-			prefix:   "lasagna",
-			name:     "mork",
-			filetype: "gif",
-			id:       "7287194dfdb24cb741413ebb7f9b121d",
-			expected: "https://garf.s3.amazonaws.com/lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.gif",
+			dump:     &imgdump{Bucket: "garf", S3: testS3Client(t, "us-east-1"), URLMode: urlModePublic},
+			key:      "lasagna/caf%C3%A9/7287194dfdb24cb741413ebb7f9b121d.gif",
+			expected: "https://garf.s3.amazonaws.com/lasagna/caf%25C3%25A9/7287194dfdb24cb741413ebb7f9b121d.gif",
 		},
 		{
-			bucket:   "garf",
-			prefix:   "lasagna",
-			name:     "mork",
-			filetype: "png",
-			id:       "7287194dfdb24cb741413ebb7f9b121d",
-			expected: "https://garf.s3.amazonaws.com/lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.png",
+			dump:     &imgdump{Bucket: "garf", S3: testS3Client(t, "eu-west-1")},
+			key:      "lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.png",
+			expected: "https://garf.s3.eu-west-1.amazonaws.com/lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.png",
+		},
+		{
+			dump:     &imgdump{Bucket: "garf", S3: testS3Client(t, "us-east-1"), URLMode: urlModeCDN, BaseURL: cdn},
+			key:      "lasagna/caf%C3%A9/7287194dfdb24cb741413ebb7f9b121d.gif",
+			expected: "https://cdn.example.com/images/lasagna/caf%25C3%25A9/7287194dfdb24cb741413ebb7f9b121d.gif",
+		},
+		{
+			// without a region the client can't build urls at all
+			dump:     &imgdump{Bucket: "garf", S3: testS3Client(t, "")},
+			key:      "lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.jpg",
+			expected: "https://garf.s3.amazonaws.com/lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.jpg",
 		},
 	}
 
 	for _, tc := range tcs {
-		id, err := imgidFromString(tc.id)
-		require.NoError(t, err)
+		assert.Equal(t, tc.expected, tc.dump.keyURL(tc.key).String(), "%s: wrong url", tc.key)
+	}
+}
 
-		assert.Equal(t,
-			tc.expected,
-			s3url(tc.bucket, tc.prefix, tc.name, tc.filetype, id).String())
+func TestImgdumpPresignedURL(t *testing.T) {
+	dump := &imgdump{
+		Bucket:      "garf",
+		S3:          testS3Client(t, "us-west-2"),
+		URLMode:     urlModePresigned,
+		URLLifetime: time.Hour,
 	}
+
+	u := dump.keyURL("lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.jpg")
+	assert.Equal(t, "garf.s3.us-west-2.amazonaws.com", u.Host)
+	assert.Equal(t, "/lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.jpg", u.Path)
+	assert.Equal(t, "3600", u.Query().Get("X-Amz-Expires"))
+	assert.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+}
+
+func TestValidS3URLConfig(t *testing.T) {
+	cdn, err := url.Parse("https://cdn.example.com/")
+	require.NoError(t, err)
+	relative, err := url.Parse("/images/")
+	require.NoError(t, err)
+
+	assert.NoError(t, validS3URLConfig(urlModePublic, 0, nil))
+	assert.NoError(t, validS3URLConfig(urlModePresigned, time.Hour, nil))
+	assert.NoError(t, validS3URLConfig(urlModeCDN, 0, cdn))
+
+	assert.Error(t, validS3URLConfig("garf", 0, nil))
+	assert.Error(t, validS3URLConfig(urlModePresigned, 0, nil))
+	assert.Error(t, validS3URLConfig(urlModePresigned, 8*24*time.Hour, nil))
+	assert.Error(t, validS3URLConfig(urlModeCDN, 0, nil))
+	assert.Error(t, validS3URLConfig(urlModeCDN, 0, relative))
 }
 
 func TestIdAndFiletype(t *testing.T) {
@@ -112,6 +185,11 @@ func TestIdAndFiletype(t *testing.T) {
 			id:       "7287194dfdb24cb741413ebb7f9b121d",
 			filetype: "gif",
 		},
+		{
+			key:      "lasagna/mork/ee6a12ab0a9a4ae6f2a4a3f0bf9bf3b0d28f5e0e1e8b4b9a8d38c14d55bc6e21.gif",
+			id:       "ee6a12ab0a9a4ae6f2a4a3f0bf9bf3b0d28f5e0e1e8b4b9a8d38c14d55bc6e21",
+			filetype: "gif",
+		},
 	}
 
 	for _, tc := range tcs {
@@ -124,4 +202,690 @@ func TestIdAndFiletype(t *testing.T) {
 		assert.Equal(t, tc.filetype, filetype, "%s: filetype not equal", tc.key)
 		assert.Equal(t, tc.err, err, "%s: err not equal", tc.key)
 	}
+
+	for _, key := range []string{"lasagna/mork/7287194d.gif", "lasagna/mork/garf.gif"} {
+		_, _, err := idAndFiletype(key)
+		assert.Error(t, err, "%s: shouldn't parse", key)
+	}
+}
+
+func TestMatchID(t *testing.T) {
+	var imgs []img
+	for _, str := range []string{
+		"7287194dfdb24cb741413ebb7f9b121d",
+		"7287194dfdb24cb741413ebb7f9b1200",
+		"f4369905865d32042ddc3c025d45eb50",
+	} {
+		id, err := imgidFromString(str)
+		require.NoError(t, err, "test setup failed")
+		imgs = append(imgs, img{ID: id})
+	}
+
+	tcs := []struct {
+		prefix  string
+		matches int
+	}{
+		{prefix: "7287194d", matches: 2},
+		{prefix: "7287194dfdb24cb741413ebb7f9b121d", matches: 1},
+		{prefix: "f436", matches: 1},
+		{prefix: "abcd", matches: 0},
+	}
+
+	for _, tc := range tcs {
+		assert.Len(t, matchID(imgs, tc.prefix), tc.matches, "%s: wrong number of matches", tc.prefix)
+	}
+}
+
+// run the imgdump integration tests against an S3-compatible store. without
+// GARF_TEST_S3_ENDPOINT they run against an in-process fake S3, which still
+// goes through the custom endpoint, path-style and static credential config.
+// to run them against something real, a throwaway MinIO works fine:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	GARF_TEST_S3_ENDPOINT=http://localhost:9000 \
+//	GARF_TEST_S3_ACCESS_KEY_ID=minioadmin GARF_TEST_S3_SECRET_ACCESS_KEY=minioadmin \
+//	go test -run Integration .
+//
+// the bucket is created if it doesn't exist, and everything the tests write is
+// under a random prefix that gets cleaned up afterwards.
+func TestImgdumpIntegration(t *testing.T) {
+	bucket := os.Getenv("GARF_TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "lasagnad-test"
+	}
+
+	config := s3Config{
+		Endpoint:        os.Getenv("GARF_TEST_S3_ENDPOINT"),
+		Region:          os.Getenv("GARF_TEST_S3_REGION"),
+		PathStyle:       true,
+		AccessKeyID:     os.Getenv("GARF_TEST_S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("GARF_TEST_S3_SECRET_ACCESS_KEY"),
+	}
+	if config.Endpoint == "" {
+		server := httptest.NewServer(newFakeS3(bucket))
+		defer server.Close()
+		config.Endpoint = server.URL
+		config.AccessKeyID = "AKIDGARF"
+		config.SecretAccessKey = "lasagna"
+	}
+
+	client, err := config.client()
+	require.NoError(t, err)
+
+	_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: &bucket})
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou || aerr.Code() == s3.ErrCodeBucketAlreadyExists) {
+		err = nil
+	}
+	require.NoError(t, err)
+
+	dump := &imgdump{
+		S3:          client,
+		Bucket:      bucket,
+		Prefix:      "lasagnad-test/" + uuid.New().String(),
+		URLMode:     urlModePresigned,
+		URLLifetime: time.Minute,
+	}
+	defer testCleanupImgdump(t, dump)
+
+	testImgdumpSuite(t, dump)
+}
+
+// delete everything under an imgdump's prefix.
+func testCleanupImgdump(t *testing.T, dump *imgdump) {
+	err := dump.S3.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: &dump.Bucket,
+		Prefix: aws.String(dump.Prefix + "/"),
+	}, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, obj := range page.Contents {
+			_, err := dump.S3.DeleteObject(&s3.DeleteObjectInput{Bucket: &dump.Bucket, Key: obj.Key})
+			assert.NoError(t, err, "cleaning up %s failed", aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	assert.NoError(t, err, "cleaning up failed")
+}
+
+// fetch an image from a url an imgdump handed out.
+func testFetchURL(t *testing.T, u *url.URL) (int, []byte) {
+	resp, err := http.Get(u.String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, bs
+}
+
+// everything an imgdump does, against an empty prefix in a real bucket (or
+// something pretending to be one). the urls it hands out have to be fetchable.
+func testImgdumpSuite(t *testing.T, dump *imgdump) {
+	ctx := context.Background()
+	bs := []byte("not actually a gif")
+	uploader := "U1234"
+
+	added, err := dump.add(ctx, "garf", "gif", bs, map[string]*string{"uploaded-by": &uploader})
+	require.NoError(t, err)
+	assert.Equal(t, newImgid(bs), added.ID)
+	code, fetched := testFetchURL(t, added.URL)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, bs, fetched)
+
+	img, err := dump.get(ctx, "garf", added.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "U1234", img.Metadata["uploaded-by"])
+	assert.Equal(t, int64(len(bs)), img.Size)
+	assert.Empty(t, img.Tags)
+
+	// the same image under another name shares a blob
+	odie, err := dump.add(ctx, "comics/odie", "gif", bs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, added.ID, odie.ID)
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "comics/odie", Count: 1}, {Name: "garf", Count: 1}}, names)
+
+	imgs, err := dump.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, added.ID, imgs[0].ID)
+	assert.Equal(t, "gif", imgs[0].Filetype)
+
+	// tags come along with copies
+	tags, err := dump.tag(ctx, "garf", added.ID, []string{"cats", "orange"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cats", "orange"}, tags)
+
+	_, err = dump.copy(ctx, "garf", "garfield", added.ID)
+	require.NoError(t, err)
+	img, err = dump.get(ctx, "garfield", added.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "U1234", img.Metadata["uploaded-by"])
+	assert.Equal(t, []string{"cats", "orange"}, img.Tags)
+
+	tagged, err := dump.tagged(ctx, "cats")
+	require.NoError(t, err)
+	require.Len(t, tagged, 2)
+	assert.Equal(t, "garf", tagged[0].Name)
+	assert.Equal(t, "garfield", tagged[1].Name)
+
+	// blobs stick around until the last name is gone
+	blob := blobKey(dump.Prefix, "gif", added.ID)
+	require.NoError(t, dump.delete(ctx, "garf", added.ID))
+	_, err = dump.get(ctx, "garf", added.ID)
+	assert.Equal(t, ErrNotFound, err)
+	exists, err := dump.exists(ctx, blob)
+	require.NoError(t, err)
+	assert.True(t, exists, "the blob should still be there")
+
+	require.NoError(t, dump.delete(ctx, "comics/odie", added.ID))
+	require.NoError(t, dump.delete(ctx, "garfield", added.ID))
+	exists, err = dump.exists(ctx, blob)
+	require.NoError(t, err)
+	assert.False(t, exists, "the blob should be gone with its last name")
+	assert.Equal(t, ErrNotFound, dump.delete(ctx, "garf", added.ID))
+
+	// aliases
+	aliases, err := dump.aliases(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, aliases)
+	require.NoError(t, dump.saveAliases(ctx, map[string]string{"garfield": "garf"}))
+	aliases, err = dump.aliases(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"garfield": "garf"}, aliases)
+
+	// an image from before blobs and sha256 ids
+	old := []byte("an old gif")
+	oldID := md5Imgid(old)
+	legacy := s3key(dump.Prefix, "nermal", "gif", oldID)
+	_, err = dump.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: &dump.Bucket,
+		Key:    &legacy,
+		Body:   bytes.NewReader(old),
+	})
+	require.NoError(t, err)
+
+	imgs, err = dump.list(ctx, "nermal")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, oldID, imgs[0].ID)
+	oldURL := imgs[0].URL
+
+	migrated, err := dump.migrateIDs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []migratedID{{Name: "nermal", From: oldID, To: newImgid(old)}}, migrated)
+
+	imgs, err = dump.list(ctx, "nermal")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, newImgid(old), imgs[0].ID)
+	_, err = dump.get(ctx, "nermal", oldID)
+	assert.Equal(t, ErrNotFound, err)
+
+	code, fetched = testFetchURL(t, oldURL)
+	require.Equal(t, http.StatusOK, code, "old urls should keep working")
+	assert.Equal(t, old, fetched)
+}
+
+func TestImgdump(t *testing.T) {
+	for _, mode := range []string{urlModePublic, urlModePresigned} {
+		mode := mode
+		t.Run(mode, func(t *testing.T) {
+			dump, _, cleanup := testImgdump(t)
+			defer cleanup()
+			dump.URLMode, dump.URLLifetime = mode, time.Minute
+
+			testImgdumpSuite(t, dump)
+		})
+	}
+}
+
+func TestImgdumpListPagination(t *testing.T) {
+	dump, fake, cleanup := testImgdump(t)
+	defer cleanup()
+	fake.Configure(func(f *fakeS3) { f.PageSize = 2 })
+
+	ctx := context.Background()
+	var added []imgid
+	for i := 0; i < 5; i++ {
+		img, err := dump.add(ctx, "garf", "gif", []byte{byte(i)}, nil)
+		require.NoError(t, err)
+		added = append(added, img.ID)
+	}
+	for _, name := range []string{"comics/garf", "mork", "mindy", "nermal"} {
+		_, err := dump.add(ctx, name, "gif", []byte(name), nil)
+		require.NoError(t, err)
+	}
+
+	listsBefore := fake.Requests("ListObjects")
+	imgs, err := dump.list(ctx, "garf")
+	require.NoError(t, err)
+	assert.Equal(t, 3, fake.Requests("ListObjects")-listsBefore, "listing 5 images 2 at a time should take 3 pages")
+
+	var listed []imgid
+	for _, img := range imgs {
+		listed = append(listed, img.ID)
+	}
+	assert.ElementsMatch(t, added, listed)
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{
+		{Name: "comics/garf", Count: 1},
+		{Name: "garf", Count: 5},
+		{Name: "mindy", Count: 1},
+		{Name: "mork", Count: 1},
+		{Name: "nermal", Count: 1},
+	}, names)
+
+	// S3 only sends a NextMarker with a delimiter, and there's no safe way to
+	// keep going without one.
+	fake.Configure(func(f *fakeS3) { f.OmitNextMarker = true })
+	_, err = dump.list(ctx, "garf")
+	assert.Error(t, err)
+}
+
+func TestImgdumpMetadata(t *testing.T) {
+	dump, fake, cleanup := testImgdump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader, channel, original := "U1234", "C1234", "https://example.com/garf.gif"
+	added, err := dump.add(ctx, "garf", "gif", []byte("a gif"), map[string]*string{
+		"uploaded-by":  &uploader,
+		"channel":      &channel,
+		"original-url": &original,
+	})
+	require.NoError(t, err)
+
+	img, err := dump.get(ctx, "garf", added.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"uploaded-by":  "U1234",
+		"channel":      "C1234",
+		"original-url": "https://example.com/garf.gif",
+	}, img.Metadata)
+	assert.False(t, img.CreatedAt.IsZero())
+
+	// metadata lives on the reference, and the blob is just the image
+	ref := fake.Object(s3key(dump.Prefix, "garf", "gif", added.ID))
+	require.NotNil(t, ref)
+	assert.Empty(t, ref.Body)
+	assert.Equal(t, "U1234", ref.Metadata["uploaded-by"])
+
+	blob := fake.Object(blobKey(dump.Prefix, "gif", added.ID))
+	require.NotNil(t, blob)
+	assert.Equal(t, []byte("a gif"), blob.Body)
+	assert.Equal(t, "image/gif", blob.ContentType)
+	assert.Empty(t, blob.Metadata)
+	assert.Equal(t, "public-read", blob.ACL)
+
+	// adding the same image again replaces its metadata
+	_, err = dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	img, err = dump.get(ctx, "garf", added.ID)
+	require.NoError(t, err)
+	assert.Empty(t, img.Metadata)
+}
+
+func TestImgdumpMigrateNames(t *testing.T) {
+	dump, fake, cleanup := testImgdump(t)
+	defer cleanup()
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	dump.Logger = logger
+
+	// an image pinned as Garf before names were normalized
+	ctx := context.Background()
+	bs := []byte("an old gif")
+	id := md5Imgid(bs)
+	oldKey := path.Join(dump.Prefix, "Garf", id.String()+".gif")
+	_, err := dump.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:   &dump.Bucket,
+		Key:      &oldKey,
+		Body:     bytes.NewReader(bs),
+		Metadata: map[string]*string{"uploaded-by": aws.String("U1234")},
+		Tagging:  aws.String("cats="),
+	})
+	require.NoError(t, err)
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	assert.Contains(t, logs.String(), "Garf", "skipped names should be logged")
+
+	renamed, err := dump.migrateNames(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []renamedPin{{From: "Garf", To: "garf", ID: id}}, renamed)
+
+	imgs, err := dump.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, id, imgs[0].ID)
+
+	img, err := dump.get(ctx, "garf", id)
+	require.NoError(t, err)
+	assert.Equal(t, "U1234", img.Metadata["uploaded-by"])
+	assert.Equal(t, []string{"cats"}, img.Tags)
+	assert.Equal(t, int64(len(bs)), img.Size)
+
+	// the old object stays put for old urls, but isn't an image anymore
+	assert.NotNil(t, fake.Object(oldKey), "the old image should be left alone")
+	names, err = dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "garf", Count: 1}}, names)
+
+	renamed, err = dump.migrateNames(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, renamed, "migrating twice shouldn't do anything")
+}
+
+func TestImgdumpNoACL(t *testing.T) {
+	dump, fake, cleanup := testImgdump(t)
+	defer cleanup()
+	dump.ACL = ""
+
+	added, err := dump.add(context.Background(), "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	blob := fake.Object(blobKey(dump.Prefix, "gif", added.ID))
+	require.NotNil(t, blob)
+	assert.Empty(t, blob.ACL)
+}
+
+func TestImgdumpErrors(t *testing.T) {
+	dump, fake, cleanup := testImgdump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	added, err := dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	// errors from S3 come back wrapped, with the original error as the cause
+	accessDenied := func(err error) bool {
+		aerr, ok := errors.Cause(err).(awserr.RequestFailure)
+		return ok && aerr.StatusCode() == http.StatusForbidden
+	}
+
+	tcs := []struct {
+		op  string
+		run func() error
+	}{
+		{op: "PutObject", run: func() error {
+			_, err := dump.add(ctx, "mork", "gif", []byte("another gif"), nil)
+			return err
+		}},
+		{op: "ListObjects", run: func() error {
+			_, err := dump.list(ctx, "garf")
+			return err
+		}},
+		{op: "ListObjects", run: func() error {
+			_, err := dump.names(ctx)
+			return err
+		}},
+		{op: "HeadObject", run: func() error {
+			_, err := dump.get(ctx, "garf", added.ID)
+			return err
+		}},
+		{op: "GetObjectTagging", run: func() error {
+			_, err := dump.get(ctx, "garf", added.ID)
+			return err
+		}},
+		{op: "CopyObject", run: func() error {
+			_, err := dump.copy(ctx, "garf", "garfield", added.ID)
+			return err
+		}},
+		{op: "PutObjectTagging", run: func() error {
+			_, err := dump.tag(ctx, "garf", added.ID, []string{"cats"})
+			return err
+		}},
+		{op: "DeleteObject", run: func() error {
+			return dump.delete(ctx, "garf", added.ID)
+		}},
+		{op: "GetObject", run: func() error {
+			_, err := dump.aliases(ctx)
+			return err
+		}},
+	}
+
+	for _, tc := range tcs {
+		fake.Configure(func(f *fakeS3) { f.Fail[tc.op] = true })
+		err := tc.run()
+		fake.Configure(func(f *fakeS3) { f.Fail[tc.op] = false })
+
+		require.Error(t, err, "%s: should have failed", tc.op)
+		assert.True(t, accessDenied(err), "%s: wrong error: %v", tc.op, err)
+	}
+
+	// images that aren't there aren't an S3 error
+	_, err = dump.get(ctx, "mork", added.ID)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, dump.delete(ctx, "mork", added.ID))
+	_, err = dump.copy(ctx, "mork", "garfield", added.ID)
+	assert.Equal(t, ErrNotFound, err)
+
+	// and nothing that failed should have left the image in a weird state
+	img, err := dump.get(ctx, "garf", added.ID)
+	require.NoError(t, err)
+	assert.Empty(t, img.Tags)
+}
+
+// serve bs, either with a Content-Length or chunked.
+func testImageServer(bs []byte, chunked bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !chunked {
+			w.Header().Set(contentLengthHeader, strconv.Itoa(len(bs)))
+			w.Write(bs)
+			return
+		}
+
+		// flushing before writing everything forces a chunked response
+		half := len(bs) / 2
+		w.Write(bs[:half])
+		w.(http.Flusher).Flush()
+		w.Write(bs[half:])
+	}))
+}
+
+func TestFetchImageBytesSizeLimit(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16))))
+	bs := buf.Bytes()
+	size := int64(len(bs))
+
+	tcs := []struct {
+		desc      string
+		chunked   bool
+		limit     int64
+		tooLarge  bool
+		observed  int64
+		truncated bool
+	}{
+		{desc: "content-length at limit", limit: size},
+		{desc: "chunked at limit", chunked: true, limit: size},
+		{desc: "content-length over limit", limit: size - 1, tooLarge: true, observed: size},
+		{desc: "chunked over limit", chunked: true, limit: size - 10, tooLarge: true, observed: size - 9, truncated: true},
+	}
+
+	for _, tc := range tcs {
+		server := testImageServer(bs, tc.chunked)
+		u, err := url.Parse(server.URL)
+		require.NoError(t, err)
+
+		limits := testImageLimits
+		limits.Bytes = tc.limit
+		fetched, filetype, err := fetchImageBytes(context.Background(), http.DefaultClient, u, limits)
+		server.Close()
+
+		if !tc.tooLarge {
+			assert.NoError(t, err, "%s: fetch should succeed", tc.desc)
+			assert.Equal(t, bs, fetched, "%s: wrong bytes", tc.desc)
+			assert.Equal(t, "png", filetype, "%s: wrong filetype", tc.desc)
+			continue
+		}
+
+		assert.Equal(t, ErrTooLarge, errors.Cause(err), "%s: expected ErrTooLarge", tc.desc)
+		sizeErr, ok := err.(*sizeError)
+		require.True(t, ok, "%s: expected a *sizeError", tc.desc)
+		assert.Equal(t, &sizeError{Size: tc.observed, Limit: tc.limit, Truncated: tc.truncated}, sizeErr, tc.desc)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tcs := []struct {
+		n        int64
+		expected string
+	}{
+		{n: 0, expected: "0 bytes"},
+		{n: 1023, expected: "1023 bytes"},
+		{n: 1024, expected: "1KB"},
+		{n: 1536, expected: "1.5KB"},
+		{n: 10485760, expected: "10MB"},
+		{n: 3 << 30, expected: "3GB"},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, humanBytes(tc.n), "%d: wrong size", tc.n)
+	}
+}
+
+var testImageLimits = imageLimits{
+	Bytes:  10 << 20,
+	Width:  1024,
+	Height: 1024,
+	Pixels: 512 * 1024,
+}
+
+// craft a grayscale PNG that claims to be width x height. only the first rows
+// rows of pixel data are actually included, so a huge image can claim to be
+// any size while staying tiny. the zeros compress extremely well, so even
+// including every row makes for a decent decompression bomb.
+func craftPNG(t testing.TB, width, height, rows int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+
+	chunk := func(kind string, data []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(kind))
+		crc.Write(data)
+		buf.WriteString(kind)
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 0 // grayscale
+	chunk("IHDR", ihdr)
+
+	var idat bytes.Buffer
+	z := zlib.NewWriter(&idat)
+	row := make([]byte, width+1) // a filter byte and then the pixels
+	for i := 0; i < rows; i++ {
+		_, err := z.Write(row)
+		require.NoError(t, err)
+	}
+	require.NoError(t, z.Close())
+	chunk("IDAT", idat.Bytes())
+	chunk("IEND", nil)
+
+	return buf.Bytes()
+}
+
+// craft a GIF with a tiny frame and a huge logical screen.
+func craftGIF(t testing.TB, width, height int) []byte {
+	var buf bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White})
+	require.NoError(t, gif.EncodeAll(&buf, &gif.GIF{
+		Image: []*image.Paletted{frame},
+		Delay: []int{0},
+		Config: image.Config{
+			ColorModel: frame.Palette,
+			Width:      width,
+			Height:     height,
+		},
+	}))
+	return buf.Bytes()
+}
+
+// craft a JPEG by encoding a tiny image and then lying about its size in the
+// start of frame header.
+func craftJPEG(t testing.TB, width, height int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil))
+	bs := buf.Bytes()
+
+	sof := bytes.Index(bs, []byte{0xff, 0xc0})
+	require.True(t, sof >= 0, "no SOF0 marker")
+	binary.BigEndian.PutUint16(bs[sof+5:], uint16(height))
+	binary.BigEndian.PutUint16(bs[sof+7:], uint16(width))
+	return bs
+}
+
+func TestDecodeImageLimits(t *testing.T) {
+	tcs := []struct {
+		desc     string
+		bs       []byte
+		filetype string
+		err      error
+	}{
+		{desc: "small png", bs: craftPNG(t, 16, 16, 16), filetype: "png"},
+		{desc: "png at limit", bs: craftPNG(t, 1024, 512, 512), filetype: "png"},
+		{desc: "wide png", bs: craftPNG(t, 1025, 1, 1), err: ErrTooManyPixels},
+		{desc: "tall png", bs: craftPNG(t, 1, 1025, 1025), err: ErrTooManyPixels},
+		{desc: "png with too many pixels", bs: craftPNG(t, 1024, 1024, 1024), err: ErrTooManyPixels},
+		{desc: "huge png", bs: craftPNG(t, 50000, 50000, 1), err: ErrTooManyPixels},
+		{desc: "small gif", bs: craftGIF(t, 16, 16), filetype: "gif"},
+		{desc: "huge gif", bs: craftGIF(t, 65535, 65535), err: ErrTooManyPixels},
+		{desc: "small jpeg", bs: craftJPEG(t, 8, 8), filetype: "jpeg"},
+		{desc: "huge jpeg", bs: craftJPEG(t, 65000, 65000), err: ErrTooManyPixels},
+		{desc: "not an image", bs: []byte("garf"), err: ErrBadImage},
+	}
+
+	for _, tc := range tcs {
+		filetype, err := decodeImage(tc.bs, testImageLimits)
+		assert.Equal(t, tc.err, errors.Cause(err), "%s: wrong error", tc.desc)
+		assert.Equal(t, tc.filetype, filetype, "%s: wrong filetype", tc.desc)
+	}
+}
+
+func TestDecodeImageMemoryBounded(t *testing.T) {
+	// a 100 megapixel PNG that's only about 100KB compressed
+	bomb := craftPNG(t, 10000, 10000, 10000)
+	require.True(t, len(bomb) < 1<<20, "bomb should be small")
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := decodeImage(bomb, testImageLimits)
+	runtime.ReadMemStats(&after)
+
+	assert.Equal(t, ErrTooManyPixels, errors.Cause(err))
+	allocated := after.TotalAlloc - before.TotalAlloc
+	assert.True(t, allocated < 1<<20, "rejecting a bomb allocated %s", humanBytes(int64(allocated)))
+}
+
+func BenchmarkDecodeImageBomb(b *testing.B) {
+	bomb := craftPNG(b, 10000, 10000, 10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeImage(bomb, testImageLimits)
+	}
+}
+
+func BenchmarkDecodeImage(b *testing.B) {
+	img := craftPNG(b, 512, 512, 512)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decodeImage(img, testImageLimits)
+	}
 }
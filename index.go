@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	// the sqlite3 driver for database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// the schema for the pin index. schema.sql is a copy for the Makefile to create
+// a db by hand with - keep them the same.
+const schema = `
+CREATE TABLE IF NOT EXISTS pins (
+    name         TEXT      NOT NULL,
+    imgid        TEXT      NOT NULL,
+    filetype     TEXT      NOT NULL,
+    uploaded_by  TEXT      NOT NULL DEFAULT '',
+    channel      TEXT      NOT NULL DEFAULT '',
+    original_url TEXT      NOT NULL DEFAULT '',
+    size_bytes   INTEGER   NOT NULL DEFAULT 0,
+    width        INTEGER   NOT NULL DEFAULT 0,
+    height       INTEGER   NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL,
+    legacy       INTEGER   NOT NULL DEFAULT 0,
+    PRIMARY KEY (name, imgid)
+);
+
+CREATE TABLE IF NOT EXISTS pin_tags (
+    name         TEXT      NOT NULL,
+    imgid        TEXT      NOT NULL,
+    tag          TEXT      NOT NULL,
+    PRIMARY KEY (name, imgid, tag)
+);
+
+CREATE INDEX IF NOT EXISTS pin_tags_by_tag ON pin_tags (tag);
+
+CREATE TABLE IF NOT EXISTS pin_favorites (
+    name         TEXT      NOT NULL,
+    imgid        TEXT      NOT NULL,
+    user_id      TEXT      NOT NULL,
+    PRIMARY KEY (name, imgid, user_id)
+);
+`
+
+// a pinRecord is everything the index knows about a single pinned image.
+type pinRecord struct {
+	Name        string
+	ID          imgid
+	Filetype    string
+	UploadedBy  string
+	Channel     string
+	OriginalURL string
+	Size        int64
+	Width       int
+	Height      int
+	CreatedAt   time.Time
+	Tags        []string
+
+	// see img.Legacy
+	Legacy bool
+}
+
+// a pinIndex is a SQLite database with a row for every pinned image. it's a
+// cache of what's in an imageStore - the store is always the source of truth
+// and the index can be rebuilt from it at any time with reindex.
+//
+// the exception is favorites, which only live in the index. reindexing leaves
+// them alone.
+type pinIndex struct {
+	DB *sql.DB
+
+	// true if the index was made before it kept track of legacy images. every
+	// record in it is treated as a blob until it's been reindexed.
+	NeedsReindex bool
+}
+
+// open the index at path, creating the database and its tables if they don't
+// exist yet.
+func openIndex(path string) (*pinIndex, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "index: open failed")
+	}
+
+	// sqlite doesn't do concurrent writes. rather than deal with SQLITE_BUSY,
+	// serialize everything through one connection.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "index: creating schema failed")
+	}
+
+	added, err := addLegacyColumn(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &pinIndex{DB: db, NeedsReindex: added}, nil
+}
+
+// add the legacy column to a pins table made before it existed. returns true
+// if it had to be added.
+func addLegacyColumn(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('pins') WHERE name = 'legacy'`).Scan(&count)
+	if err != nil {
+		return false, errors.Wrap(err, "index: checking schema failed")
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if _, err := db.Exec(`ALTER TABLE pins ADD COLUMN legacy INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return false, errors.Wrap(err, "index: adding legacy column failed")
+	}
+	return true, nil
+}
+
+func (idx *pinIndex) Close() error {
+	return idx.DB.Close()
+}
+
+// insert or replace a record, along with its tags
+func (idx *pinIndex) insert(ctx context.Context, r pinRecord) error {
+	tx, err := idx.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "index: begin failed")
+	}
+	if err := insertRecord(ctx, tx, r); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "index: commit failed")
+}
+
+// remove the record for an image, its tags and its favorites. removing a
+// record that doesn't exist isn't an error.
+func (idx *pinIndex) remove(ctx context.Context, name string, id imgid) error {
+	tx, err := idx.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "index: begin failed")
+	}
+	for _, table := range []string{"pins", "pin_tags", "pin_favorites"} {
+		_, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE name = ? AND imgid = ?`, name, id.String())
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "index: delete failed")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "index: commit failed")
+}
+
+// favorite an image for a user and return how many users have favorited it.
+// favoriting the same image twice doesn't count twice.
+func (idx *pinIndex) favorite(ctx context.Context, name string, id imgid, user string) (int, error) {
+	hexID := id.String()
+	_, err := idx.DB.ExecContext(ctx, `INSERT OR IGNORE INTO pin_favorites (name, imgid, user_id) VALUES (?, ?, ?)`, name, hexID, user)
+	if err != nil {
+		return 0, errors.Wrap(err, "index: inserting favorite failed")
+	}
+
+	var count int
+	err = idx.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM pin_favorites WHERE name = ? AND imgid = ?`, name, hexID).Scan(&count)
+	if err != nil {
+		return 0, errors.Wrap(err, "index: counting favorites failed")
+	}
+	return count, nil
+}
+
+// count the favorites of every image pinned under any of the given names.
+// images without any favorites are left out.
+func (idx *pinIndex) favorites(ctx context.Context, names ...string) (map[pinKey]int, error) {
+	counts := make(map[pinKey]int)
+	for _, name := range names {
+		rows, err := idx.DB.QueryContext(ctx, `
+			SELECT imgid, COUNT(*)
+			FROM pin_favorites
+			WHERE name = ?
+			GROUP BY imgid`, name)
+		if err != nil {
+			return nil, errors.Wrap(err, "index: counting favorites failed")
+		}
+
+		for rows.Next() {
+			var hexID string
+			var count int
+			if err := rows.Scan(&hexID, &count); err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "index: counting favorites failed")
+			}
+			id, err := imgidFromString(hexID)
+			if err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "index: found invalid imgid")
+			}
+			counts[pinKey{Name: name, ID: id}] = count
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "index: counting favorites failed")
+		}
+	}
+	return counts, nil
+}
+
+// copy every favorite of an image to the same image under another name.
+func (idx *pinIndex) copyFavorites(ctx context.Context, from, to string, id imgid) error {
+	_, err := idx.DB.ExecContext(ctx, `
+		INSERT OR IGNORE INTO pin_favorites (name, imgid, user_id)
+		SELECT ?, imgid, user_id FROM pin_favorites WHERE name = ? AND imgid = ?`,
+		to, from, id.String())
+	return errors.Wrap(err, "index: copying favorites failed")
+}
+
+// move the records, tags and favorites for images that migrate-ids gave a new
+// id over to the new id. if an image is already indexed under its new id, the
+// old record is dropped and its tags and favorites are merged into the new one.
+//
+// migrate-ids re-pins every image it migrates, so the new ids are always blobs
+// even if the old ones weren't.
+func (idx *pinIndex) changeIDs(ctx context.Context, migrated []migratedID) error {
+	tx, err := idx.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "index: begin failed")
+	}
+	for _, m := range migrated {
+		for _, table := range []string{"pins", "pin_tags", "pin_favorites"} {
+			_, err := tx.ExecContext(ctx, `UPDATE OR IGNORE `+table+` SET imgid = ? WHERE name = ? AND imgid = ?`, m.To.String(), m.Name, m.From.String())
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "index: update failed")
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE name = ? AND imgid = ?`, m.Name, m.From.String())
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "index: delete failed")
+			}
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE pins SET legacy = 0 WHERE name = ? AND imgid = ?`, m.Name, m.To.String())
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "index: update failed")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "index: commit failed")
+}
+
+// replace the tags for an image.
+func (idx *pinIndex) setTags(ctx context.Context, name string, id imgid, tags []string) error {
+	tx, err := idx.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "index: begin failed")
+	}
+	if err := insertTags(ctx, tx, name, id, tags); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "index: commit failed")
+}
+
+// list the name, id, filetype and legacy flag of every image with a tag, oldest
+// first. the rest of each record is left empty.
+func (idx *pinIndex) tagged(ctx context.Context, tag string) ([]pinRecord, error) {
+	rows, err := idx.DB.QueryContext(ctx, `
+		SELECT pins.name, pins.imgid, pins.filetype, pins.legacy
+		FROM pins
+		JOIN pin_tags ON pins.name = pin_tags.name AND pins.imgid = pin_tags.imgid
+		WHERE pin_tags.tag = ?
+		ORDER BY pins.created_at, pins.name, pins.imgid`, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "index: listing tagged images failed")
+	}
+	defer rows.Close()
+
+	var records []pinRecord
+	for rows.Next() {
+		var r pinRecord
+		var hexID string
+		if err := rows.Scan(&r.Name, &hexID, &r.Filetype, &r.Legacy); err != nil {
+			return nil, errors.Wrap(err, "index: listing tagged images failed")
+		}
+		if r.ID, err = imgidFromString(hexID); err != nil {
+			return nil, errors.Wrap(err, "index: found invalid imgid")
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "index: listing tagged images failed")
+	}
+
+	return records, nil
+}
+
+// list every record with the given name, oldest first.
+func (idx *pinIndex) list(ctx context.Context, name string) ([]pinRecord, error) {
+	rows, err := idx.DB.QueryContext(ctx, `
+		SELECT name, imgid, filetype, uploaded_by, channel, original_url, size_bytes, width, height, created_at, legacy
+		FROM pins
+		WHERE name = ?
+		ORDER BY created_at, imgid`, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "index: list failed")
+	}
+	defer rows.Close()
+
+	var records []pinRecord
+	for rows.Next() {
+		var r pinRecord
+		var hexID string
+		err := rows.Scan(&r.Name, &hexID, &r.Filetype, &r.UploadedBy, &r.Channel, &r.OriginalURL, &r.Size, &r.Width, &r.Height, &r.CreatedAt, &r.Legacy)
+		if err != nil {
+			return nil, errors.Wrap(err, "index: list failed")
+		}
+		if r.ID, err = imgidFromString(hexID); err != nil {
+			return nil, errors.Wrap(err, "index: found invalid imgid")
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "index: list failed")
+	}
+
+	return records, nil
+}
+
+// list every name in the index and count its images.
+func (idx *pinIndex) names(ctx context.Context) ([]nameCount, error) {
+	rows, err := idx.DB.QueryContext(ctx, `SELECT name, COUNT(*) FROM pins GROUP BY name ORDER BY name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "index: listing names failed")
+	}
+	defer rows.Close()
+
+	var names []nameCount
+	for rows.Next() {
+		var n nameCount
+		if err := rows.Scan(&n.Name, &n.Count); err != nil {
+			return nil, errors.Wrap(err, "index: listing names failed")
+		}
+		names = append(names, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "index: listing names failed")
+	}
+
+	return names, nil
+}
+
+// replace everything in the index with the given records. happens in a single
+// transaction, so nobody reading the index sees it half built.
+func (idx *pinIndex) replace(ctx context.Context, records []pinRecord) error {
+	tx, err := idx.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "index: begin failed")
+	}
+
+	for _, table := range []string{"pins", "pin_tags"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "index: clear failed")
+		}
+	}
+	for _, r := range records {
+		if err := insertRecord(ctx, tx, r); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "index: commit failed")
+}
+
+// the subset of *sql.DB and *sql.Tx that insertRecord needs
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertRecord(ctx context.Context, db execer, r pinRecord) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO pins
+			(name, imgid, filetype, uploaded_by, channel, original_url, size_bytes, width, height, created_at, legacy)
+		VALUES
+			(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Name, r.ID.String(), r.Filetype, r.UploadedBy, r.Channel, r.OriginalURL, r.Size, r.Width, r.Height, r.CreatedAt.UTC(), r.Legacy)
+	if err != nil {
+		return errors.Wrap(err, "index: insert failed")
+	}
+	return insertTags(ctx, db, r.Name, r.ID, r.Tags)
+}
+
+// replace every tag on an image
+func insertTags(ctx context.Context, db execer, name string, id imgid, tags []string) error {
+	hexID := id.String()
+	if _, err := db.ExecContext(ctx, `DELETE FROM pin_tags WHERE name = ? AND imgid = ?`, name, hexID); err != nil {
+		return errors.Wrap(err, "index: clearing tags failed")
+	}
+	for _, tag := range tags {
+		if _, err := db.ExecContext(ctx, `INSERT INTO pin_tags (name, imgid, tag) VALUES (?, ?, ?)`, name, hexID, tag); err != nil {
+			return errors.Wrap(err, "index: inserting tags failed")
+		}
+	}
+	return nil
+}
+
+// an indexedStore is an imageStore that keeps a pinIndex up to date with every
+// add, copy and delete, and answers list and names from the index instead of the
+// underlying store.
+type indexedStore struct {
+	imageStore
+	Index *pinIndex
+}
+
+func (s *indexedStore) add(ctx context.Context, name, filetype string, bs []byte, metadata map[string]*string) (*img, error) {
+	added, err := s.imageStore.add(ctx, name, filetype, bs, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	flattened := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if v != nil {
+			flattened[k] = *v
+		}
+	}
+
+	// adding an image is idempotent, so if the index insert fails pinning the
+	// same image again will fix it.
+	record := newPinRecord(added, int64(len(bs)), time.Now(), flattened)
+	if err := s.Index.insert(ctx, record); err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+func (s *indexedStore) delete(ctx context.Context, name string, id imgid) error {
+	if err := s.imageStore.delete(ctx, name, id); err != nil {
+		return err
+	}
+	return s.Index.remove(ctx, name, id)
+}
+
+// copy an image and index the copy. the copy keeps the original's metadata and
+// creation time.
+func (s *indexedStore) copy(ctx context.Context, from, to string, id imgid) (*img, error) {
+	original, err := s.imageStore.get(ctx, from, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// the underlying store's idea of when the original was created might just be
+	// when it was last copied, so prefer the index's.
+	createdAt := original.CreatedAt
+	records, err := s.Index.list(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r.ID == id {
+			createdAt = r.CreatedAt
+		}
+	}
+
+	copied, err := s.imageStore.copy(ctx, from, to, id)
+	if err != nil {
+		return nil, err
+	}
+
+	record := newPinRecord(copied, original.Size, createdAt, original.Metadata)
+	record.Tags = original.Tags
+	if err := s.Index.insert(ctx, record); err != nil {
+		return nil, err
+	}
+	if err := s.Index.copyFavorites(ctx, from, to, id); err != nil {
+		return nil, err
+	}
+
+	return copied, nil
+}
+
+func (s *indexedStore) tag(ctx context.Context, name string, id imgid, tags []string) ([]string, error) {
+	merged, err := s.imageStore.tag(ctx, name, id, tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Index.setTags(ctx, name, id, merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func (s *indexedStore) tagged(ctx context.Context, tag string) ([]img, error) {
+	records, err := s.Index.tagged(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	return s.imgs(records), nil
+}
+
+func (s *indexedStore) list(ctx context.Context, name string) ([]img, error) {
+	records, err := s.Index.list(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.imgs(records), nil
+}
+
+// turn records into imgs. images pinned before blobs existed might not have a
+// blob yet, so they get the url they've always had.
+func (s *indexedStore) imgs(records []pinRecord) []img {
+	imgs := make([]img, len(records))
+	for i, r := range records {
+		u := s.imgURL(r.Name, r.Filetype, r.ID)
+		if r.Legacy {
+			u = s.legacyURL(r.Name, r.Filetype, r.ID)
+		}
+		imgs[i] = img{
+			Name:     r.Name,
+			ID:       r.ID,
+			Filetype: r.Filetype,
+			URL:      u,
+			Legacy:   r.Legacy,
+		}
+	}
+	return imgs
+}
+
+func (s *indexedStore) names(ctx context.Context) ([]nameCount, error) {
+	return s.Index.names(ctx)
+}
+
+// rebuild the index from scratch by walking every image in the underlying
+// store. this fetches metadata for every single image, so it's slow.
+func (s *indexedStore) reindex(ctx context.Context) (int, error) {
+	names, err := s.imageStore.names(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var records []pinRecord
+	for _, name := range names {
+		imgs, err := s.imageStore.list(ctx, name.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, listed := range imgs {
+			img, err := s.imageStore.get(ctx, listed.Name, listed.ID)
+			if err == ErrNotFound {
+				// deleted out from under the reindex. skip it.
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			records = append(records, newPinRecord(img, img.Size, img.CreatedAt, img.Metadata))
+		}
+	}
+
+	return len(records), s.Index.replace(ctx, records)
+}
+
+// give every image with an md5 id a new id, and update the index to match so
+// nothing loses its creation time or favorites.
+func (s *indexedStore) migrateIDs(ctx context.Context) ([]migratedID, error) {
+	migrator, ok := s.imageStore.(idMigrator)
+	if !ok {
+		return nil, errors.New("index: can't migrate ids in this image store")
+	}
+
+	// update the index for everything that got migrated, even if something
+	// went wrong partway through.
+	migrated, err := migrator.migrateIDs(ctx)
+	if indexErr := s.Index.changeIDs(ctx, migrated); indexErr != nil {
+		return migrated, indexErr
+	}
+	return migrated, err
+}
+
+// copy every image under a name that isn't normalized to the name it
+// normalizes to, and index the copies. images under names like that were never
+// in the index, so there's nothing to keep.
+func (s *indexedStore) migrateNames(ctx context.Context) ([]renamedPin, error) {
+	migrator, ok := s.imageStore.(nameMigrator)
+	if !ok {
+		return nil, errors.New("index: can't migrate names in this image store")
+	}
+
+	// index everything that got copied, even if something went wrong partway
+	// through.
+	renamed, err := migrator.migrateNames(ctx)
+	for _, r := range renamed {
+		img, getErr := s.imageStore.get(ctx, r.To, r.ID)
+		if getErr != nil {
+			return renamed, getErr
+		}
+		record := newPinRecord(img, img.Size, img.CreatedAt, img.Metadata)
+		if indexErr := s.Index.insert(ctx, record); indexErr != nil {
+			return renamed, indexErr
+		}
+	}
+	return renamed, err
+}
+
+// build a record from an image, its size and when it was created, and its
+// metadata. see handlePin for the metadata that gets stored with an image.
+func newPinRecord(img *img, size int64, createdAt time.Time, metadata map[string]string) pinRecord {
+	width, _ := strconv.Atoi(metadata["width"])
+	height, _ := strconv.Atoi(metadata["height"])
+
+	return pinRecord{
+		Name:        img.Name,
+		ID:          img.ID,
+		Filetype:    img.Filetype,
+		UploadedBy:  metadata["uploaded-by"],
+		Channel:     metadata["channel"],
+		OriginalURL: metadata["original-url"],
+		Size:        size,
+		Width:       width,
+		Height:      height,
+		CreatedAt:   createdAt,
+		Tags:        img.Tags,
+		Legacy:      img.Legacy,
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testIndexedStore(t *testing.T) (*indexedStore, func()) {
+	dump, cleanup := testLocaldump(t)
+
+	index, err := openIndex(filepath.Join(dump.Dir, "garf.db"))
+	require.NoError(t, err)
+
+	return &indexedStore{imageStore: dump, Index: index}, func() {
+		index.Close()
+		cleanup()
+	}
+}
+
+func TestSchemaMatchesSchemaFile(t *testing.T) {
+	bs, err := ioutil.ReadFile("schema.sql")
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(bs)), strings.TrimSpace(schema), "schema.sql is out of date")
+}
+
+func TestIndexedStore(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader, channel, width, height := "U1234", "C1234", "640", "480"
+	added, err := store.add(ctx, "mork", "png", []byte("a png"), map[string]*string{
+		"uploaded-by": &uploader,
+		"channel":     &channel,
+		"width":       &width,
+		"height":      &height,
+	})
+	require.NoError(t, err)
+	_, err = store.add(ctx, "mindy", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	records, err := store.Index.list(ctx, "mork")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, added.ID, records[0].ID)
+	assert.Equal(t, "U1234", records[0].UploadedBy)
+	assert.Equal(t, "C1234", records[0].Channel)
+	assert.Equal(t, int64(len("a png")), records[0].Size)
+	assert.Equal(t, 640, records[0].Width)
+	assert.Equal(t, 480, records[0].Height)
+
+	imgs, err := store.list(ctx, "mork")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, added.URL, imgs[0].URL)
+
+	names, err := store.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "mindy", Count: 1}, {Name: "mork", Count: 1}}, names)
+
+	require.NoError(t, store.delete(ctx, "mork", added.ID))
+	imgs, err = store.list(ctx, "mork")
+	require.NoError(t, err)
+	assert.Empty(t, imgs)
+}
+
+func TestIndexedStoreReindex(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader := "U1234"
+
+	// add images straight to the underlying store so the index doesn't know
+	// about them
+	for _, name := range []string{"mork", "mindy"} {
+		_, err := store.imageStore.add(ctx, name, "gif", []byte(name), map[string]*string{"uploaded-by": &uploader})
+		require.NoError(t, err)
+	}
+
+	names, err := store.names(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	count, err := store.reindex(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	names, err = store.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "mindy", Count: 1}, {Name: "mork", Count: 1}}, names)
+
+	records, err := store.Index.list(ctx, "mork")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "U1234", records[0].UploadedBy)
+	assert.Equal(t, int64(len("mork")), records[0].Size)
+	assert.False(t, records[0].CreatedAt.IsZero())
+}
+
+func TestIndexedStoreLegacyImages(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	dump := store.imageStore.(*localdump)
+	id := testLegacyImage(t, dump, "garf", []byte("an old gif"), nil)
+	added, err := store.add(ctx, "garf", "gif", []byte("a new gif"), nil)
+	require.NoError(t, err)
+
+	_, err = store.reindex(ctx)
+	require.NoError(t, err)
+
+	imgs, err := store.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 2)
+	urls := map[imgid]string{imgs[0].ID: imgs[0].URL.String(), imgs[1].ID: imgs[1].URL.String()}
+	assert.Equal(t, dump.legacyURL("garf", "gif", id).String(), urls[id], "images without a blob should keep their old url")
+	assert.Equal(t, added.URL.String(), urls[added.ID])
+}
+
+func TestOpenIndexAddsLegacyColumn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lasagnad")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "garf.db")
+
+	// the pins table from before it had a legacy column
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE pins (
+			name         TEXT      NOT NULL,
+			imgid        TEXT      NOT NULL,
+			filetype     TEXT      NOT NULL,
+			uploaded_by  TEXT      NOT NULL DEFAULT '',
+			channel      TEXT      NOT NULL DEFAULT '',
+			original_url TEXT      NOT NULL DEFAULT '',
+			size_bytes   INTEGER   NOT NULL DEFAULT 0,
+			width        INTEGER   NOT NULL DEFAULT 0,
+			height       INTEGER   NOT NULL DEFAULT 0,
+			created_at   TIMESTAMP NOT NULL,
+			PRIMARY KEY (name, imgid)
+		)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	index, err := openIndex(path)
+	require.NoError(t, err)
+	assert.True(t, index.NeedsReindex)
+	require.NoError(t, index.insert(context.Background(), pinRecord{Name: "garf", ID: newImgid([]byte("a gif")), Filetype: "gif", Legacy: true}))
+	require.NoError(t, index.Close())
+
+	index, err = openIndex(path)
+	require.NoError(t, err)
+	defer index.Close()
+	assert.False(t, index.NeedsReindex)
+
+	records, err := index.list(context.Background(), "garf")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.True(t, records[0].Legacy)
+}
+
+func TestIndexedStoreCopy(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader := "U1234"
+	added, err := store.add(ctx, "garf", "gif", []byte("a gif"), map[string]*string{"uploaded-by": &uploader})
+	require.NoError(t, err)
+
+	original, err := store.Index.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, original, 1)
+
+	_, err = store.copy(ctx, "garf", "garfield", added.ID)
+	require.NoError(t, err)
+
+	records, err := store.Index.list(ctx, "garfield")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, added.ID, records[0].ID)
+	assert.Equal(t, "U1234", records[0].UploadedBy)
+	assert.True(t, original[0].CreatedAt.Equal(records[0].CreatedAt), "copies should keep their creation time")
+}
+
+func TestIndexedStoreTags(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	garf, err := store.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	odie, err := store.add(ctx, "odie", "gif", []byte("another gif"), nil)
+	require.NoError(t, err)
+
+	_, err = store.tag(ctx, "garf", garf.ID, []string{"cats", "orange"})
+	require.NoError(t, err)
+	_, err = store.tag(ctx, "odie", odie.ID, []string{"dogs"})
+	require.NoError(t, err)
+	_, err = store.copy(ctx, "garf", "garfield", garf.ID)
+	require.NoError(t, err)
+
+	tagged, err := store.tagged(ctx, "cats")
+	require.NoError(t, err)
+	require.Len(t, tagged, 2)
+	assert.Equal(t, "garf", tagged[0].Name)
+	assert.Equal(t, "garfield", tagged[1].Name)
+
+	require.NoError(t, store.delete(ctx, "garf", garf.ID))
+	tagged, err = store.tagged(ctx, "cats")
+	require.NoError(t, err)
+	require.Len(t, tagged, 1, "deleting an image should untag it")
+
+	// wipe the index and make sure reindexing brings the tags back
+	require.NoError(t, store.Index.replace(ctx, nil))
+	_, err = store.reindex(ctx)
+	require.NoError(t, err)
+
+	tagged, err = store.tagged(ctx, "dogs")
+	require.NoError(t, err)
+	require.Len(t, tagged, 1)
+	assert.Equal(t, odie.ID, tagged[0].ID)
+}
+
+func TestIndexedStoreFavorites(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	garf, err := store.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	odie, err := store.add(ctx, "odie", "gif", []byte("another gif"), nil)
+	require.NoError(t, err)
+
+	for _, user := range []string{"U1", "U2", "U1"} {
+		_, err := store.Index.favorite(ctx, "garf", garf.ID, user)
+		require.NoError(t, err)
+	}
+	count, err := store.Index.favorite(ctx, "odie", odie.ID, "U1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	favorites, err := store.Index.favorites(ctx, "garf", "odie")
+	require.NoError(t, err)
+	assert.Equal(t, map[pinKey]int{{"garf", garf.ID}: 2, {"odie", odie.ID}: 1}, favorites)
+
+	// favorites follow copies, get cleaned up on delete, and survive a reindex
+	_, err = store.copy(ctx, "garf", "garfield", garf.ID)
+	require.NoError(t, err)
+	require.NoError(t, store.delete(ctx, "garf", garf.ID))
+	_, err = store.reindex(ctx)
+	require.NoError(t, err)
+
+	favorites, err = store.Index.favorites(ctx, "garf", "garfield")
+	require.NoError(t, err)
+	assert.Equal(t, map[pinKey]int{{"garfield", garf.ID}: 2}, favorites)
+}
+
+func TestIndexedStoreMigrateIDs(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bs := []byte("an old gif")
+	oldID := testLegacyImage(t, store.imageStore.(*localdump), "garf", bs, nil)
+	_, err := store.reindex(ctx)
+	require.NoError(t, err)
+	_, err = store.Index.favorite(ctx, "garf", oldID, "U1")
+	require.NoError(t, err)
+
+	original, err := store.Index.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, original, 1)
+	require.True(t, original[0].Legacy)
+
+	migrated, err := store.migrateIDs(ctx)
+	require.NoError(t, err)
+	require.Len(t, migrated, 1)
+
+	newID := newImgid(bs)
+	records, err := store.Index.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, newID, records[0].ID)
+	assert.True(t, original[0].CreatedAt.Equal(records[0].CreatedAt), "migrating should keep the creation time")
+	assert.False(t, records[0].Legacy, "migrated images should be blobs")
+
+	imgs, err := store.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, store.imgURL("garf", "gif", newID), imgs[0].URL)
+
+	favorites, err := store.Index.favorites(ctx, "garf")
+	require.NoError(t, err)
+	assert.Equal(t, map[pinKey]int{{"garf", newID}: 1}, favorites)
+}
+
+func TestIndexedStoreMigrateNames(t *testing.T) {
+	store, cleanup := testIndexedStore(t)
+	defer cleanup()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	dump := store.imageStore.(*localdump)
+	dump.Logger = logger
+
+	ctx := context.Background()
+	bs := []byte("an old gif")
+	id := testLegacyKey(t, dump, "Garf", bs, map[string]string{"uploaded-by": "U1234"})
+	_, err := store.reindex(ctx)
+	require.NoError(t, err)
+
+	renamed, err := store.migrateNames(ctx)
+	require.NoError(t, err)
+	require.Len(t, renamed, 1)
+
+	records, err := store.Index.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, id, records[0].ID)
+	assert.Equal(t, "U1234", records[0].UploadedBy)
+	assert.False(t, records[0].Legacy, "migrated images should be blobs")
+
+	names, err := store.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "garf", Count: 1}}, names)
+}
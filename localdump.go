@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// a localdump is an imageStore that keeps images in a directory on the local
+// filesystem instead of in S3. images are laid out exactly like they are in an
+// imgdump, with Dir standing in for the bucket:
+//
+//	<dir>/<prefix>/blobs/<image_sha256>.<filetype>
+//	<dir>/<prefix>/blobs/<image_sha256>/<name>
+//	<dir>/<prefix>/<name>/<image_sha256>.<filetype>
+//
+// see blobs.go. metadata and tags for each image are kept in hidden json files
+// next to its reference, and aren't ever served over HTTP.
+//
+// a localdump is also an http.Handler that serves the images it stores. the
+// URLs it hands out are relative to BaseURL, so BaseURL should point at
+// wherever the handler is mounted.
+type localdump struct {
+	Dir     string
+	Prefix  string
+	BaseURL *url.URL
+
+	// where to complain about files that can't be read. defaults to logrus's
+	// standard logger.
+	Logger logrus.FieldLogger
+}
+
+// add an image to the dump. like an imgdump, the blob is only written if it's
+// not there already, and this overwrites an existing image if and only if the
+// image bytes, filetype and the name are identical.
+func (dump *localdump) add(ctx context.Context, name, filetype string, bs []byte, metadata map[string]*string) (*img, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !validPinName(name) {
+		return nil, ErrInvalidPinName
+	}
+
+	imgid := newImgid(bs)
+	key := s3key(dump.Prefix, name, filetype, imgid)
+
+	flattened := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if v != nil {
+			flattened[k] = *v
+		}
+	}
+	metadataBytes, err := json.Marshal(flattened)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding metadata failed")
+	}
+
+	if err := dump.touch(blobRefKey(dump.Prefix, name, imgid)); err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
+	uploaded, err := dump.writeBlob(blobKey(dump.Prefix, filetype, imgid), bs)
+	if err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
+	blobWritesTotal.WithLabelValues(blobWriteResult(uploaded)).Inc()
+
+	if err := os.MkdirAll(filepath.Dir(dump.path(key)), 0755); err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
+	if err := writeFileAtomic(dump.path(metadataKey(key)), metadataBytes); err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
+	if err := writeFileAtomic(dump.path(key), nil); err != nil {
+		return nil, errors.Wrap(err, "upload failed")
+	}
+	// re-uploading an object to S3 clears its tags, so do the same here
+	if err := os.Remove(dump.path(tagsKey(key))); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "upload failed")
+	}
+
+	return &img{
+		Name:     name,
+		ID:       imgid,
+		Filetype: filetype,
+		URL:      dump.imgURL(name, filetype, imgid),
+	}, nil
+}
+
+// list all images with the given name.
+func (dump *localdump) list(ctx context.Context, name string) ([]img, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !validPinName(name) {
+		return nil, ErrInvalidPinName
+	}
+
+	prefix := s3prefix(dump.Prefix, name)
+	entries, err := ioutil.ReadDir(dump.path(prefix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "listing images failed")
+	}
+
+	images := imageKeys(dump.entryKeys(prefix, entries))
+
+	var imgs []img
+	for _, entry := range entries {
+		key := path.Join(prefix, entry.Name())
+		if !images[key] {
+			continue
+		}
+
+		imgid, filetype, err := idAndFiletype(key)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+		}
+		imgs = append(imgs, img{
+			Name:     name,
+			ID:       imgid,
+			Filetype: filetype,
+			URL:      dump.objectURL(key, entry.Size()),
+			Legacy:   entry.Size() > 0,
+		})
+	}
+
+	return imgs, nil
+}
+
+// list every name in the dump and count its images.
+func (dump *localdump) names(ctx context.Context) ([]nameCount, error) {
+	dirs, err := dump.nameDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNameDirs(storeLogger(dump.Logger), dirs), nil
+}
+
+// list every directory in the dump that has images in it. names are the
+// directories under the prefix that have images in them, including namespaced
+// names one directory further down.
+func (dump *localdump) nameDirs(ctx context.Context) ([]nameDir, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var dirs []nameDir
+	var walk func(name string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := ioutil.ReadDir(dump.path(path.Join(dump.Prefix, dir)))
+		if err != nil {
+			return err
+		}
+
+		images := imageKeys(dump.entryKeys(dir, entries))
+
+		count := 0
+		var subdirs []string
+		for _, entry := range entries {
+			switch {
+			case strings.HasPrefix(entry.Name(), "."):
+				continue
+			case depth == 0 && entry.Name() == blobsDir:
+				continue
+			case entry.IsDir():
+				subdirs = append(subdirs, entry.Name())
+			case images[path.Join(dir, entry.Name())]:
+				count++
+			}
+		}
+
+		if depth > 0 && count > 0 {
+			dirs = append(dirs, nameDir{Dir: dir, Count: count})
+		}
+
+		if depth < maxPinNameSegments {
+			for _, subdir := range subdirs {
+				if err := walk(path.Join(dir, subdir), depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := walk("", 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "listing names failed")
+	}
+	return dirs, nil
+}
+
+// get a single image and all of its metadata.
+func (dump *localdump) get(ctx context.Context, name string, id imgid) (*img, error) {
+	key, err := dump.find(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, filetype, err := idAndFiletype(key)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+	}
+
+	info, err := os.Stat(dump.path(key))
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching image failed")
+	}
+	size := info.Size()
+	if size == 0 {
+		blob, err := os.Stat(dump.path(blobKey(dump.Prefix, filetype, id)))
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching image blob failed")
+		}
+		size = blob.Size()
+	}
+
+	metadata := make(map[string]string)
+	metadataBytes, err := ioutil.ReadFile(dump.path(metadataKey(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "fetching image metadata failed")
+	}
+	if err == nil {
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			return nil, errors.Wrap(err, "fetching image metadata failed")
+		}
+	}
+
+	tags, err := dump.readTags(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &img{
+		Name:      name,
+		ID:        id,
+		Filetype:  filetype,
+		URL:       dump.objectURL(key, info.Size()),
+		Size:      size,
+		Legacy:    info.Size() > 0,
+		CreatedAt: info.ModTime(),
+		Metadata:  metadata,
+		Tags:      tags,
+	}, nil
+}
+
+// delete a single image, its metadata and its tags, and its blob if nothing
+// else refers to it.
+func (dump *localdump) delete(ctx context.Context, name string, id imgid) error {
+	key, err := dump.find(ctx, name, id)
+	if err != nil {
+		return err
+	}
+	_, filetype, err := idAndFiletype(key)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+	}
+
+	if err := os.Remove(dump.path(key)); err != nil {
+		return errors.Wrap(err, "deleting image failed")
+	}
+	if err := os.Remove(dump.path(metadataKey(key))); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "deleting image metadata failed")
+	}
+	if err := os.Remove(dump.path(tagsKey(key))); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "deleting image tags failed")
+	}
+	if err := os.Remove(dump.path(blobRefKey(dump.Prefix, name, id))); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "deleting image failed")
+	}
+
+	return dump.collectBlob(filetype, id)
+}
+
+// delete a blob if nothing refers to it anymore.
+func (dump *localdump) collectBlob(filetype string, id imgid) error {
+	refs := dump.path(blobRefsPrefix(dump.Prefix, id))
+	referenced := false
+	err := filepath.Walk(refs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			referenced = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "checking blob references failed")
+	}
+	if referenced {
+		return nil
+	}
+
+	if err := os.RemoveAll(refs); err != nil {
+		return errors.Wrap(err, "deleting blob failed")
+	}
+	if err := os.Remove(dump.path(blobKey(dump.Prefix, filetype, id))); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "deleting blob failed")
+	}
+	blobsCollectedTotal.Inc()
+	return nil
+}
+
+// write a blob, unless it's already there. returns true if it was written.
+func (dump *localdump) writeBlob(key string, bs []byte) (bool, error) {
+	if _, err := os.Stat(dump.path(key)); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dump.path(key)), 0755); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(dump.path(key), bs); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// create an empty file for a key.
+func (dump *localdump) touch(key string) error {
+	if err := os.MkdirAll(filepath.Dir(dump.path(key)), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(dump.path(key), nil)
+}
+
+// add tags to an image.
+func (dump *localdump) tag(ctx context.Context, name string, id imgid, tags []string) ([]string, error) {
+	key, err := dump.find(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := dump.readTags(key)
+	if err != nil {
+		return nil, err
+	}
+	merged := mergeTags(existing, tags)
+	if len(merged) > maxTagsPerImage {
+		return nil, ErrTooManyTags
+	}
+
+	bs, err := json.Marshal(merged)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding tags failed")
+	}
+	if err := writeFileAtomic(dump.path(tagsKey(key)), bs); err != nil {
+		return nil, errors.Wrap(err, "tagging image failed")
+	}
+
+	return merged, nil
+}
+
+// list every image with a tag by checking every image's tags.
+func (dump *localdump) tagged(ctx context.Context, tag string) ([]img, error) {
+	names, err := dump.names(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []img
+	for _, name := range names {
+		imgs, err := dump.list(ctx, name.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, img := range imgs {
+			key, err := dump.find(ctx, img.Name, img.ID)
+			if err != nil {
+				return nil, err
+			}
+			tags, err := dump.readTags(key)
+			if err != nil {
+				return nil, err
+			}
+			if hasTag(tags, tag) {
+				tagged = append(tagged, img)
+			}
+		}
+	}
+
+	return tagged, nil
+}
+
+// read the tags for the image with the given key. images without any tags
+// don't have a tags file at all.
+func (dump *localdump) readTags(key string) ([]string, error) {
+	bs, err := ioutil.ReadFile(dump.path(tagsKey(key)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching image tags failed")
+	}
+
+	var tags []string
+	if err := json.Unmarshal(bs, &tags); err != nil {
+		return nil, errors.Wrap(err, "decoding image tags failed")
+	}
+	return tags, nil
+}
+
+// load the alias map. see aliases.go
+func (dump *localdump) aliases(ctx context.Context) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	bs, err := ioutil.ReadFile(dump.path(aliasesKey(dump.Prefix)))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching aliases failed")
+	}
+
+	aliases := make(map[string]string)
+	if err := json.Unmarshal(bs, &aliases); err != nil {
+		return nil, errors.Wrap(err, "decoding aliases failed")
+	}
+	return aliases, nil
+}
+
+// save the alias map.
+func (dump *localdump) saveAliases(ctx context.Context, aliases map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(aliases)
+	if err != nil {
+		return errors.Wrap(err, "encoding aliases failed")
+	}
+
+	filename := dump.path(aliasesKey(dump.Prefix))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return errors.Wrap(err, "saving aliases failed")
+	}
+	if err := writeFileAtomic(filename, bs); err != nil {
+		return errors.Wrap(err, "saving aliases failed")
+	}
+	return nil
+}
+
+// copy an image's reference, metadata and tags to another name. copying an
+// image pinned before blobs existed makes a blob for it.
+func (dump *localdump) copy(ctx context.Context, from, to string, id imgid) (*img, error) {
+	if !validPinName(to) {
+		return nil, ErrInvalidPinName
+	}
+
+	key, err := dump.find(ctx, from, id)
+	if err != nil {
+		return nil, err
+	}
+	return dump.copyKey(key, to, id)
+}
+
+// copy the image at key to another name.
+func (dump *localdump) copyKey(key, to string, id imgid) (*img, error) {
+	_, filetype, err := idAndFiletype(key)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+	}
+
+	metadataBytes, err := ioutil.ReadFile(dump.path(metadataKey(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "copying image metadata failed")
+	}
+	tagsBytes, err := ioutil.ReadFile(dump.path(tagsKey(key)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "copying image tags failed")
+	}
+
+	if err := dump.touch(blobRefKey(dump.Prefix, to, id)); err != nil {
+		return nil, errors.Wrap(err, "copying image failed")
+	}
+	if err := dump.ensureBlob(key, filetype, id); err != nil {
+		return nil, errors.Wrap(err, "copying image failed")
+	}
+
+	dest := s3key(dump.Prefix, to, filetype, id)
+	if err := os.MkdirAll(filepath.Dir(dump.path(dest)), 0755); err != nil {
+		return nil, errors.Wrap(err, "copying image failed")
+	}
+	if metadataBytes != nil {
+		if err := writeFileAtomic(dump.path(metadataKey(dest)), metadataBytes); err != nil {
+			return nil, errors.Wrap(err, "copying image metadata failed")
+		}
+	}
+	if tagsBytes != nil {
+		if err := writeFileAtomic(dump.path(tagsKey(dest)), tagsBytes); err != nil {
+			return nil, errors.Wrap(err, "copying image tags failed")
+		}
+	} else if err := os.Remove(dump.path(tagsKey(dest))); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "copying image tags failed")
+	}
+	if err := writeFileAtomic(dump.path(dest), nil); err != nil {
+		return nil, errors.Wrap(err, "copying image failed")
+	}
+
+	return &img{
+		Name:     to,
+		ID:       id,
+		Filetype: filetype,
+		URL:      dump.imgURL(to, filetype, id),
+	}, nil
+}
+
+// make sure an image has a blob. images pinned before blobs existed have their
+// bytes in their reference, so the blob gets copied from there.
+func (dump *localdump) ensureBlob(key, filetype string, id imgid) error {
+	blob := blobKey(dump.Prefix, filetype, id)
+	if _, err := os.Stat(dump.path(blob)); err == nil {
+		return nil
+	}
+
+	bs, err := ioutil.ReadFile(dump.path(key))
+	if err != nil {
+		return err
+	}
+	if len(bs) == 0 {
+		return fmt.Errorf("imgdump: blob missing for %q", key)
+	}
+	_, err = dump.writeBlob(blob, bs)
+	return err
+}
+
+// make blobs and reference markers for every image pinned before blobs
+// existed. like an imgdump, the old images are left alone.
+func (dump *localdump) migrateBlobs(ctx context.Context) (int, error) {
+	names, err := dump.names(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, name := range names {
+		prefix := s3prefix(dump.Prefix, name.Name)
+		entries, err := ioutil.ReadDir(dump.path(prefix))
+		if err != nil {
+			return migrated, errors.Wrap(err, "listing images failed")
+		}
+
+		images := imageKeys(dump.entryKeys(prefix, entries))
+		for _, entry := range entries {
+			key := path.Join(prefix, entry.Name())
+			if !images[key] || entry.Size() == 0 {
+				continue
+			}
+			id, filetype, err := idAndFiletype(key)
+			if err != nil {
+				return migrated, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+			}
+
+			if err := dump.touch(blobRefKey(dump.Prefix, name.Name, id)); err != nil {
+				return migrated, errors.Wrap(err, "migrating image failed")
+			}
+			if err := dump.ensureBlob(key, filetype, id); err != nil {
+				return migrated, errors.Wrap(err, "migrating image failed")
+			}
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// give every image with an md5 id a new id. see idMigrator.
+func (dump *localdump) migrateIDs(ctx context.Context) ([]migratedID, error) {
+	read := func(ctx context.Context, img *img) ([]byte, error) {
+		key, err := dump.find(ctx, img.Name, img.ID)
+		if err != nil {
+			return nil, err
+		}
+		// images pinned before blobs existed are their own blob
+		bs, err := ioutil.ReadFile(dump.path(key))
+		if err != nil || len(bs) > 0 {
+			return bs, err
+		}
+		return ioutil.ReadFile(dump.path(blobKey(dump.Prefix, img.Filetype, img.ID)))
+	}
+	markMigrated := func(ctx context.Context, img *img) error {
+		key, err := dump.find(ctx, img.Name, img.ID)
+		if err != nil {
+			return err
+		}
+		return dump.touch(migratedKey(key))
+	}
+	return migrateStoreIDs(ctx, dump, read, markMigrated)
+}
+
+// copy every image under a name that isn't normalized to the name it
+// normalizes to. see nameMigrator.
+func (dump *localdump) migrateNames(ctx context.Context) ([]renamedPin, error) {
+	dirs, err := dump.nameDirs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rename := func(ctx context.Context, dir, to string) ([]imgid, error) {
+		prefix := path.Join(dump.Prefix, dir)
+		entries, err := ioutil.ReadDir(dump.path(prefix))
+		if err != nil {
+			return nil, errors.Wrap(err, "listing images failed")
+		}
+
+		images := imageKeys(dump.entryKeys(prefix, entries))
+
+		var ids []imgid
+		for _, entry := range entries {
+			key := path.Join(prefix, entry.Name())
+			if !images[key] {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return ids, err
+			}
+
+			id, _, err := idAndFiletype(key)
+			if err != nil {
+				return ids, errors.Wrap(err, fmt.Sprintf("imgdump: found invalid image key: %q", key))
+			}
+			if _, err := dump.copyKey(key, to, id); err != nil {
+				return ids, err
+			}
+			if err := dump.touch(migratedKey(key)); err != nil {
+				return ids, errors.Wrap(err, "marking image as migrated failed")
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	return migrateStoreNames(ctx, storeLogger(dump.Logger), dirs, rename)
+}
+
+// find the full key for an image, whatever its extension is.
+func (dump *localdump) find(ctx context.Context, name string, id imgid) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if !validPinName(name) {
+		return "", ErrInvalidPinName
+	}
+
+	pattern := dump.path(fmt.Sprintf("%s/%s.*", s3prefix(dump.Prefix, name), id))
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", errors.Wrap(err, "finding image failed")
+	}
+	if len(matches) == 0 {
+		return "", ErrNotFound
+	}
+
+	key, err := filepath.Rel(dump.Dir, matches[0])
+	if err != nil {
+		return "", errors.Wrap(err, "finding image failed")
+	}
+	key = filepath.ToSlash(key)
+
+	// like an imgdump, md5 images that have been given a new id are only still
+	// around for old urls.
+	if id.Version == idMD5 {
+		if _, err := os.Stat(dump.path(migratedKey(key))); err == nil {
+			return "", ErrNotFound
+		}
+	}
+	return key, nil
+}
+
+// the keys of the files in a directory listing, for imageKeys. directories
+// aren't included.
+func (dump *localdump) entryKeys(dir string, entries []os.FileInfo) []string {
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			keys = append(keys, path.Join(dir, entry.Name()))
+		}
+	}
+	return keys
+}
+
+// serve the images in this dump. anything that isn't an image, including
+// metadata, directory listings, and empty references, is a 404.
+func (dump *localdump) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || strings.HasPrefix(segment, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	info, err := os.Stat(dump.path(key))
+	if err != nil || info.IsDir() || info.Size() == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, dump.path(key))
+}
+
+// the path on disk for a key
+func (dump *localdump) path(key string) string {
+	return filepath.Join(dump.Dir, filepath.FromSlash(key))
+}
+
+// the public url for an image, which is the url of its blob.
+func (dump *localdump) imgURL(name, filetype string, id imgid) *url.URL {
+	return dump.keyURL(blobKey(dump.Prefix, filetype, id))
+}
+
+// the public url for an image pinned before blobs existed.
+func (dump *localdump) legacyURL(name, filetype string, id imgid) *url.URL {
+	return dump.keyURL(s3key(dump.Prefix, name, filetype, id))
+}
+
+// the public url for an image, given its reference's key and size. see
+// imgdump.objectURL
+func (dump *localdump) objectURL(key string, size int64) *url.URL {
+	if size > 0 {
+		return dump.keyURL(key)
+	}
+	id, filetype, _ := idAndFiletype(key)
+	return dump.imgURL("", filetype, id)
+}
+
+// the public url for a key
+func (dump *localdump) keyURL(key string) *url.URL {
+	u := *dump.BaseURL
+	u.Path = path.Join("/", u.Path, key)
+	return &u
+}
+
+// the key for an image's metadata file. metadata files are hidden so they're
+// skipped when listing and never served.
+func metadataKey(key string) string {
+	dir, file := path.Split(key)
+	return dir + "." + file + ".json"
+}
+
+// the key for an image's tags file. like metadata files, tags files are hidden.
+func tagsKey(key string) string {
+	dir, file := path.Split(key)
+	return dir + "." + file + ".tags.json"
+}
+
+// write a file by writing to a temp file and renaming it into place, so that
+// nothing ever sees or serves a partially written image.
+func writeFileAtomic(filename string, bs []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
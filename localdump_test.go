@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLocaldump(t *testing.T) (*localdump, func()) {
+	dir, err := ioutil.TempDir("", "lasagnad")
+	require.NoError(t, err)
+
+	baseURL, err := url.Parse("http://localhost:8080/images/")
+	require.NoError(t, err)
+
+	return &localdump{Dir: dir, Prefix: "lasagna", BaseURL: baseURL}, func() { os.RemoveAll(dir) }
+}
+
+func TestLocaldumpAddAndList(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bs := []byte("not actually a gif")
+	uploader := "garf"
+
+	added, err := dump.add(ctx, "mork", "gif", bs, map[string]*string{"uploaded-by": &uploader})
+	require.NoError(t, err)
+
+	id := newImgid(bs)
+	assert.Equal(t, id, added.ID)
+	assert.Equal(t, "http://localhost:8080/images/lasagna/blobs/"+id.String()+".gif", added.URL.String())
+
+	stored, err := ioutil.ReadFile(filepath.Join(dump.Dir, "lasagna", "blobs", id.String()+".gif"))
+	require.NoError(t, err)
+	assert.Equal(t, bs, stored)
+
+	ref, err := ioutil.ReadFile(filepath.Join(dump.Dir, "lasagna", "mork", id.String()+".gif"))
+	require.NoError(t, err)
+	assert.Empty(t, ref, "refs shouldn't hold a copy of the image")
+
+	imgs, err := dump.list(ctx, "mork")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1, "metadata should not be listed")
+	assert.Equal(t, id, imgs[0].ID)
+	assert.Equal(t, "gif", imgs[0].Filetype)
+
+	imgs, err = dump.list(ctx, "mindy")
+	require.NoError(t, err)
+	assert.Empty(t, imgs)
+}
+
+func TestLocaldumpNames(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i, name := range []string{"mork", "mindy", "mork"} {
+		_, err := dump.add(ctx, name, "gif", []byte{byte(i)}, nil)
+		require.NoError(t, err)
+	}
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "mindy", Count: 1}, {Name: "mork", Count: 2}}, names)
+}
+
+func TestLocaldumpNamespaces(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i, name := range []string{"garf", "garf/odie", "garf-x", "comics/garf", "comics/garf"} {
+		_, err := dump.add(ctx, name, "gif", []byte{byte(i)}, nil)
+		require.NoError(t, err)
+	}
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{
+		{Name: "comics/garf", Count: 2},
+		{Name: "garf", Count: 1},
+		{Name: "garf-x", Count: 1},
+		{Name: "garf/odie", Count: 1},
+	}, names, "comics is only a namespace and shouldn't be a name")
+
+	imgs, err := dump.list(ctx, "garf")
+	require.NoError(t, err)
+	assert.Len(t, imgs, 1, "listing a name shouldn't include its namespace")
+
+	imgs, err = dump.list(ctx, "comics/garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 2)
+	assert.Equal(t, "comics/garf", imgs[0].Name)
+	assert.Contains(t, imgs[0].URL.String(), "/lasagna/blobs/")
+}
+
+func TestLocaldumpUnicodeNames(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i, name := range []string{"🍝", "café", "comics/🍝"} {
+		_, err := dump.add(ctx, name, "gif", []byte{byte(i)}, nil)
+		require.NoError(t, err)
+	}
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{
+		{Name: "café", Count: 1},
+		{Name: "comics/🍝", Count: 1},
+		{Name: "🍝", Count: 1},
+	}, names)
+
+	imgs, err := dump.list(ctx, "café")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, "café", imgs[0].Name)
+	assert.Equal(t, "http://localhost:8080/images/lasagna/blobs/"+imgs[0].ID.String()+".gif", imgs[0].URL.String())
+
+	_, err = os.Stat(filepath.Join(dump.Dir, "lasagna", "caf%C3%A9"))
+	assert.NoError(t, err, "names should be encoded on disk")
+
+	// the URL the store hands out has to be servable
+	server := httptest.NewServer(http.StripPrefix("/images/", dump))
+	defer server.Close()
+	resp, err := http.Get(server.URL + imgs[0].URL.EscapedPath())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLocaldumpAliases(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	aliases, err := dump.aliases(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, aliases, "nothing has been aliased yet")
+
+	_, err = dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	require.NoError(t, dump.saveAliases(ctx, map[string]string{"garfield": "garf", "🍝": "garf"}))
+
+	aliases, err = dump.aliases(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"garfield": "garf", "🍝": "garf"}, aliases)
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "garf", Count: 1}}, names, "aliases shouldn't show up as names")
+
+	resp := httptest.NewRecorder()
+	dump.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/lasagna/.aliases.json", nil))
+	assert.Equal(t, http.StatusNotFound, resp.Code, "aliases shouldn't be served")
+}
+
+func TestLocaldumpCopy(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader := "U1234"
+	added, err := dump.add(ctx, "garf", "gif", []byte("a gif"), map[string]*string{"uploaded-by": &uploader})
+	require.NoError(t, err)
+
+	copied, err := dump.copy(ctx, "garf", "comics/garf", added.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "comics/garf", copied.Name)
+	assert.Equal(t, added.ID, copied.ID)
+	assert.Equal(t, added.URL, copied.URL, "copies should share a blob")
+
+	img, err := dump.get(ctx, "comics/garf", added.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "U1234", img.Metadata["uploaded-by"], "metadata should be copied")
+
+	_, err = dump.get(ctx, "garf", added.ID)
+	assert.NoError(t, err, "the original should still be there")
+
+	_, err = dump.copy(ctx, "garf", "comics/garf", added.ID)
+	assert.NoError(t, err, "copying again should be fine")
+
+	_, err = dump.copy(ctx, "odie", "comics/garf", added.ID)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = dump.copy(ctx, "garf", "../garf", added.ID)
+	assert.Equal(t, ErrInvalidPinName, err)
+}
+
+func TestLocaldumpTags(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	garf, err := dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	odie, err := dump.add(ctx, "comics/odie", "png", []byte("a png"), nil)
+	require.NoError(t, err)
+	_, err = dump.add(ctx, "nermal", "png", []byte("another png"), nil)
+	require.NoError(t, err)
+
+	tags, err := dump.tag(ctx, "garf", garf.ID, []string{"cats", "orange"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cats", "orange"}, tags)
+
+	tags, err = dump.tag(ctx, "garf", garf.ID, []string{"lasagna", "cats"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cats", "lasagna", "orange"}, tags, "tags should be merged")
+
+	_, err = dump.tag(ctx, "comics/odie", odie.ID, []string{"lasagna"})
+	require.NoError(t, err)
+
+	img, err := dump.get(ctx, "garf", garf.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cats", "lasagna", "orange"}, img.Tags)
+
+	tagged, err := dump.tagged(ctx, "lasagna")
+	require.NoError(t, err)
+	require.Len(t, tagged, 2)
+	assert.Equal(t, "comics/odie", tagged[0].Name)
+	assert.Equal(t, "garf", tagged[1].Name)
+
+	tagged, err = dump.tagged(ctx, "dogs")
+	require.NoError(t, err)
+	assert.Empty(t, tagged)
+
+	var tooMany []string
+	for i := 0; i < maxTagsPerImage; i++ {
+		tooMany = append(tooMany, strings.Repeat("a", i+1))
+	}
+	_, err = dump.tag(ctx, "garf", garf.ID, tooMany)
+	assert.Equal(t, ErrTooManyTags, err)
+
+	_, err = dump.copy(ctx, "garf", "garfield", garf.ID)
+	require.NoError(t, err)
+	img, err = dump.get(ctx, "garfield", garf.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cats", "lasagna", "orange"}, img.Tags, "copies should keep their tags")
+
+	_, err = dump.add(ctx, "garfield", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	img, err = dump.get(ctx, "garfield", garf.ID)
+	require.NoError(t, err)
+	assert.Empty(t, img.Tags, "pinning again should clear tags")
+
+	require.NoError(t, dump.delete(ctx, "garf", garf.ID))
+	_, err = os.Stat(dump.path(tagsKey(s3key(dump.Prefix, "garf", "gif", garf.ID))))
+	assert.True(t, os.IsNotExist(err), "deleting an image should delete its tags")
+}
+
+func TestLocaldumpTaggedOldImages(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	// an md5 image saved as .jpeg, which isn't the extension s3key would give
+	// it now.
+	ctx := context.Background()
+	id := md5Imgid([]byte("an old jpeg"))
+	key := s3prefix(dump.Prefix, "garf") + "/" + id.String() + ".jpeg"
+	require.NoError(t, os.MkdirAll(filepath.Dir(dump.path(key)), 0755))
+	require.NoError(t, ioutil.WriteFile(dump.path(key), []byte("an old jpeg"), 0644))
+
+	_, err := dump.tag(ctx, "garf", id, []string{"cats"})
+	require.NoError(t, err)
+
+	tagged, err := dump.tagged(ctx, "cats")
+	require.NoError(t, err)
+	require.Len(t, tagged, 1)
+	assert.Equal(t, id, tagged[0].ID)
+	assert.Equal(t, "jpeg", tagged[0].Filetype)
+}
+
+func TestLocaldumpInvalidNames(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, name := range []string{"../escaped", "../../escaped", "garf/../../escaped", "GARF", ""} {
+		_, err := dump.add(ctx, name, "gif", []byte("a gif"), nil)
+		assert.Equal(t, ErrInvalidPinName, err, "%q: add should fail", name)
+
+		_, err = dump.list(ctx, name)
+		assert.Equal(t, ErrInvalidPinName, err, "%q: list should fail", name)
+
+		_, err = dump.get(ctx, name, newImgid([]byte("a gif")))
+		assert.Equal(t, ErrInvalidPinName, err, "%q: get should fail", name)
+
+		err = dump.delete(ctx, name, newImgid([]byte("a gif")))
+		assert.Equal(t, ErrInvalidPinName, err, "%q: delete should fail", name)
+	}
+
+	_, err := os.Stat(filepath.Join(dump.Dir, "escaped"))
+	assert.True(t, os.IsNotExist(err), "nothing should be written outside the prefix")
+}
+
+func TestLocaldumpGetAndDelete(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader := "garf"
+	added, err := dump.add(ctx, "mork", "png", []byte("a png"), map[string]*string{"uploaded-by": &uploader})
+	require.NoError(t, err)
+
+	got, err := dump.get(ctx, "mork", added.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "png", got.Filetype)
+	assert.Equal(t, map[string]string{"uploaded-by": "garf"}, got.Metadata)
+
+	require.NoError(t, dump.delete(ctx, "mork", added.ID))
+
+	_, err = dump.get(ctx, "mork", added.ID)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, dump.delete(ctx, "mork", added.ID))
+
+	imgs, err := dump.list(ctx, "mork")
+	require.NoError(t, err)
+	assert.Empty(t, imgs)
+}
+
+func TestLocaldumpServeHTTP(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	added, err := dump.add(context.Background(), "mork", "jpeg", []byte("a jpeg"), nil)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		path string
+		code int
+	}{
+		{path: "/lasagna/blobs/" + added.ID.String() + ".jpg", code: http.StatusOK},
+		{path: "/lasagna/blobs/" + added.ID.String() + "/mork", code: http.StatusNotFound},
+		{path: "/lasagna/mork/" + added.ID.String() + ".jpg", code: http.StatusNotFound},
+		{path: "/lasagna/mork/." + added.ID.String() + ".jpg.json", code: http.StatusNotFound},
+		{path: "/lasagna/mork/", code: http.StatusNotFound},
+		{path: "/lasagna/mork/../../../etc/passwd", code: http.StatusNotFound},
+		{path: "/lasagna/mindy/" + added.ID.String() + ".jpg", code: http.StatusNotFound},
+	}
+
+	for _, tc := range tcs {
+		resp := httptest.NewRecorder()
+		dump.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		assert.Equal(t, tc.code, resp.Code, "%s: wrong response code", tc.path)
+	}
+}
+
+func TestLocaldumpBlobs(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bs := []byte("a gif")
+	garf, err := dump.add(ctx, "garf", "gif", bs, nil)
+	require.NoError(t, err)
+	odie, err := dump.add(ctx, "comics/odie", "gif", bs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, garf.URL, odie.URL, "the same image should share a blob")
+
+	blobs, err := filepath.Glob(filepath.Join(dump.Dir, "lasagna", "blobs", "*.gif"))
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1)
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "comics/odie", Count: 1}, {Name: "garf", Count: 1}}, names, "blobs shouldn't show up as names")
+
+	blob := filepath.Join(dump.Dir, "lasagna", "blobs", garf.ID.String()+".gif")
+	markers := filepath.Join(dump.Dir, "lasagna", "blobs", garf.ID.String())
+
+	require.NoError(t, dump.delete(ctx, "garf", garf.ID))
+	_, err = os.Stat(blob)
+	assert.NoError(t, err, "the blob should stick around while something refers to it")
+
+	require.NoError(t, dump.delete(ctx, "comics/odie", odie.ID))
+	_, err = os.Stat(blob)
+	assert.True(t, os.IsNotExist(err), "the blob should be deleted with its last reference")
+	_, err = os.Stat(markers)
+	assert.True(t, os.IsNotExist(err), "reference markers should be cleaned up")
+}
+
+func TestLocaldumpMigrateBlobs(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	bs := []byte("an old gif")
+	id := testLegacyImage(t, dump, "garf", bs, nil)
+
+	ctx := context.Background()
+	imgs, err := dump.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, "http://localhost:8080/images/lasagna/garf/"+id.String()+".gif", imgs[0].URL.String(), "old images should keep their old urls")
+
+	count, err := dump.migrateBlobs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	stored, err := ioutil.ReadFile(filepath.Join(dump.Dir, "lasagna", "blobs", id.String()+".gif"))
+	require.NoError(t, err)
+	assert.Equal(t, bs, stored)
+	_, err = os.Stat(filepath.Join(dump.Dir, "lasagna", "blobs", id.String(), "garf"))
+	assert.NoError(t, err, "migrating should leave a reference marker")
+
+	_, err = dump.migrateBlobs(ctx)
+	assert.NoError(t, err, "migrating twice should be fine")
+
+	// copies of migrated images share the new blob
+	_, err = dump.copy(ctx, "garf", "garfield", id)
+	require.NoError(t, err)
+	require.NoError(t, dump.delete(ctx, "garf", id))
+	img, err := dump.get(ctx, "garfield", id)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/images/lasagna/blobs/"+id.String()+".gif", img.URL.String())
+}
+
+// write an image the way it was stored before blobs and sha256 ids existed,
+// with the whole image in a file named after its md5.
+func testLegacyImage(t *testing.T, dump *localdump, name string, bs []byte, metadata map[string]string) imgid {
+	return testLegacyKey(t, dump, encodePinName(name), bs, metadata)
+}
+
+// write a legacy image into a directory under the dump's prefix, whether or not
+// the directory is a valid encoded name.
+func testLegacyKey(t *testing.T, dump *localdump, dir string, bs []byte, metadata map[string]string) imgid {
+	id := md5Imgid(bs)
+	key := path.Join(dump.Prefix, dir, id.String()+".gif")
+	require.NoError(t, os.MkdirAll(filepath.Dir(dump.path(key)), 0755))
+	require.NoError(t, ioutil.WriteFile(dump.path(key), bs, 0644))
+
+	if metadata != nil {
+		metadataBytes, err := json.Marshal(metadata)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(dump.path(metadataKey(key)), metadataBytes, 0644))
+	}
+	return id
+}
+
+func TestLocaldumpMigrateIDs(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bs := []byte("an old gif")
+	oldID := testLegacyImage(t, dump, "garf", bs, map[string]string{"uploaded-by": "U1234"})
+	_, err := dump.tag(ctx, "garf", oldID, []string{"cats"})
+	require.NoError(t, err)
+
+	// copies made after blobs existed keep the old id, but get a blob
+	_, err = dump.copy(ctx, "garf", "garfield", oldID)
+	require.NoError(t, err)
+
+	var oldURLs []*url.URL
+	for _, name := range []string{"garf", "garfield"} {
+		imgs, err := dump.list(ctx, name)
+		require.NoError(t, err)
+		require.Len(t, imgs, 1)
+		oldURLs = append(oldURLs, imgs[0].URL)
+	}
+
+	migrated, err := dump.migrateIDs(ctx)
+	require.NoError(t, err)
+	newID := newImgid(bs)
+	assert.Equal(t, []migratedID{
+		{Name: "garf", From: oldID, To: newID},
+		{Name: "garfield", From: oldID, To: newID},
+	}, migrated)
+
+	for _, name := range []string{"garf", "garfield"} {
+		imgs, err := dump.list(ctx, name)
+		require.NoError(t, err)
+		require.Len(t, imgs, 1, "%s: the old image shouldn't be listed", name)
+		assert.Equal(t, newID, imgs[0].ID)
+
+		img, err := dump.get(ctx, name, newID)
+		require.NoError(t, err)
+		assert.Equal(t, "U1234", img.Metadata["uploaded-by"], "%s: metadata should be kept", name)
+		assert.Equal(t, []string{"cats"}, img.Tags, "%s: tags should be kept", name)
+
+		_, err = dump.get(ctx, name, oldID)
+		assert.Equal(t, ErrNotFound, err)
+	}
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "garf", Count: 1}, {Name: "garfield", Count: 1}}, names)
+
+	// urls that have already been posted should keep working
+	server := httptest.NewServer(http.StripPrefix("/images/", dump))
+	defer server.Close()
+	for _, u := range oldURLs {
+		resp, err := http.Get(server.URL + u.EscapedPath())
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "%s: should still be served", u)
+	}
+
+	migrated, err = dump.migrateIDs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, migrated, "migrating twice shouldn't do anything")
+}
+
+func TestLocaldumpMigrateNames(t *testing.T) {
+	dump, cleanup := testLocaldump(t)
+	defer cleanup()
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	dump.Logger = logger
+
+	// older versions of lasagnad would pin under anything with a letter or a
+	// number in it, without normalizing it first.
+	ctx := context.Background()
+	bs := []byte("an old gif")
+	id := testLegacyKey(t, dump, "Garf", bs, map[string]string{"uploaded-by": "U1234"})
+	testLegacyKey(t, dump, "Comics/GARF", bs, nil)
+	testLegacyKey(t, dump, "garf?", bs, nil)
+	oldKey := path.Join(dump.Prefix, "Garf", id.String()+".gif")
+
+	names, err := dump.names(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+	for _, dir := range []string{"Garf", "Comics/GARF", "garf?"} {
+		assert.Contains(t, logs.String(), dir, "%s: should be logged", dir)
+	}
+
+	renamed, err := dump.migrateNames(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []renamedPin{
+		{From: "Comics/GARF", To: "comics/garf", ID: id},
+		{From: "Garf", To: "garf", ID: id},
+	}, renamed)
+
+	names, err = dump.names(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []nameCount{{Name: "comics/garf", Count: 1}, {Name: "garf", Count: 1}}, names)
+
+	img, err := dump.get(ctx, "garf", id)
+	require.NoError(t, err)
+	assert.Equal(t, "U1234", img.Metadata["uploaded-by"], "metadata should be kept")
+	stored, err := ioutil.ReadFile(dump.path(blobKey(dump.Prefix, "gif", id)))
+	require.NoError(t, err)
+	assert.Equal(t, bs, stored)
+
+	// the old image sticks around for old urls, but only names that can't be
+	// migrated get complained about now.
+	_, err = os.Stat(dump.path(oldKey))
+	assert.NoError(t, err, "the old image should be left alone")
+
+	logs.Reset()
+	_, err = dump.names(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, logs.String(), "Garf")
+	assert.Contains(t, logs.String(), "garf?")
+
+	renamed, err = dump.migrateNames(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, renamed, "migrating twice shouldn't do anything")
+}
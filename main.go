@@ -1,24 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/hex"
 	"flag"
 	"fmt"
+	"image"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/gops/agent"
 	"github.com/google/uuid"
 	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
 	"github.com/rakyll/globalconf"
 	"github.com/sirupsen/logrus"
 )
@@ -39,16 +43,72 @@ var (
 
 // image options
 var (
-	imgOpts         = flagset("img")
-	imgBucket       = imgOpts.String("bucket", "", "the s3 bucket to store images in")
-	imgPrefix       = imgOpts.String("prefix", "", "the s3 prefix to use to namespace images")
-	imgMaxSizeBytes = imgOpts.Int64("max-size-bytes", -1, "the maximum allowed image size, in bytes")
+	imgOpts            = flagset("img")
+	imgStore           = imgOpts.String("store", "s3", "where to store images. one of: s3, local")
+	imgBucket          = imgOpts.String("bucket", "", "the s3 bucket to store images in")
+	imgEndpoint        = imgOpts.String("endpoint", "", "the url of an s3-compatible endpoint, like minio. if empty, images are stored in aws")
+	imgRegion          = imgOpts.String("region", "", "the s3 region. if empty, it comes from the environment")
+	imgPathStyle       = imgOpts.Bool("path-style", false, "use path-style s3 urls, which most s3-compatible stores need")
+	imgAccessKeyID     = imgOpts.String("access-key-id", "", "an s3 access key id. if empty, credentials come from the environment")
+	imgSecretAccessKey = imgOpts.String("secret-access-key", "", "the secret access key that goes with access-key-id")
+	imgPrefix          = imgOpts.String("prefix", "", "the s3 prefix to use to namespace images")
+	imgDir             = imgOpts.String("dir", "", "the directory to store images in when using the local store")
+	imgListenAddr      = imgOpts.String("listen-addr", ":8080", "the address to serve images on when using the local store")
+	imgBaseURL         = imgOpts.String("base-url", "", "the public url images are served from when using the local store or a cdn")
+	imgURLMode         = imgOpts.String("url-mode", urlModePublic, "how to hand out urls for images stored in s3. one of: public, presigned, cdn")
+	imgURLLifetime     = imgOpts.Duration("url-lifetime", 24*time.Hour, "how long presigned urls are good for")
+	imgACL             = imgOpts.String("acl", "public-read", "the canned ACL to upload images to s3 with, or \"none\" to upload them without one")
+	imgMaxSizeBytes    = imgOpts.Int64("max-size-bytes", -1, "the maximum allowed image size, in bytes")
+	imgMaxWidth        = imgOpts.Int("max-width", 8192, "the maximum allowed image width, in pixels")
+	imgMaxHeight       = imgOpts.Int("max-height", 8192, "the maximum allowed image height, in pixels")
+	imgMaxPixels       = imgOpts.Int64("max-pixels", 25000000, "the maximum allowed number of pixels in an image")
+	imgAllowDomains    = imgOpts.String("allow-domains", "", "a comma separated list of the only domains to fetch images from. if empty, any public domain is allowed")
+	imgDenyDomains     = imgOpts.String("deny-domains", "", "a comma separated list of domains to never fetch images from")
+)
+
+// slack opts
+var (
+	slackOpts       = flagset("slack")
+	slackTransport  = slackOpts.String("transport", "rtm", "how to receive messages from slack. one of: rtm, events")
+	slackEventsAddr = slackOpts.String("events-addr", ":3000", "the address to listen for Events API callbacks on when using the events transport")
+	slackPinReact   = slackOpts.String("pin-reaction", "", "reacting to a message with this emoji pins the image in it. if empty, reactions are ignored")
+	slackDeleteFile = slackOpts.Bool("delete-pinned-files", false, "delete files uploaded to slack once they've been pinned")
+)
+
+// worker opts. commands that fetch images are slow and use a lot of memory, so
+// they get their own pool.
+var (
+	workerOpts       = flagset("workers")
+	workerFetch      = workerOpts.Int("fetch", 4, "the number of fetch-heavy commands (like !pin) to handle at once")
+	workerFetchQueue = workerOpts.Int("fetch-queue", 16, "the number of fetch-heavy commands to queue before telling users to try again")
+	workerOther      = workerOpts.Int("other", 16, "the number of other commands to handle at once")
+	workerOtherQueue = workerOpts.Int("other-queue", 64, "the number of other commands to queue before telling users to try again")
+)
+
+// metrics opts
+var (
+	metricsOpts = flagset("metrics")
+	metricsAddr = metricsOpts.String("addr", "", "the address to serve prometheus metrics on. if empty, metrics aren't served")
+)
+
+// show opts
+var (
+	showOpts            = flagset("show")
+	showWeightFavorites = showOpts.Bool("weight-favorites", false, "show images that have been favorited with !fav more often. needs an index")
+)
+
+// index opts
+var (
+	indexOpts = flagset("index")
+	indexPath = indexOpts.String("path", "", "the path to a sqlite db to index pins in. if empty, pins aren't indexed")
 )
 
 // auth opts
 var (
-	authOpts  = flagset("auth")
-	authToken = authOpts.String("token", "", "the auth token to use to connect to Slack")
+	authOpts   = flagset("auth")
+	authToken  = authOpts.String("token", "", "the auth token to use to connect to Slack")
+	authAdmins = authOpts.String("admins", "", "a comma separated list of Slack user ids that can unpin anything")
+	authSecret = authOpts.String("signing-secret", "", "the signing secret used to verify Events API requests from Slack")
 )
 
 func main() {
@@ -59,20 +119,130 @@ func main() {
 	conf.EnvPrefix = "GARF_"
 	conf.ParseAll()
 
-	if *imgBucket == "" || *imgPrefix == "" || *imgMaxSizeBytes <= 0 {
-		log.Fatalf("invalid s3 bucket config! need a bucket, prefix, and a valid max size in bytes")
+	if *imgPrefix == "" || *imgMaxSizeBytes <= 0 {
+		log.Fatalf("invalid img config! need a prefix and a valid max size in bytes")
+	}
+
+	if *imgMaxWidth <= 0 || *imgMaxHeight <= 0 || *imgMaxPixels <= 0 {
+		log.Fatalf("invalid img config! max-width, max-height and max-pixels have to be positive")
+	}
+
+	if *workerFetch < 1 || *workerOther < 1 || *workerFetchQueue < 0 || *workerOtherQueue < 0 {
+		log.Fatalf("invalid workers config! need at least one worker per pool and a non-negative queue size")
+	}
+
+	botLogger := logger(*debug)
+	store := imageStoreFromFlags(botLogger)
+	policy := &fetchPolicy{
+		AllowDomains: commaList(*imgAllowDomains),
+		DenyDomains:  commaList(*imgDenyDomains),
+	}
+	limits := imageLimits{
+		Bytes:  *imgMaxSizeBytes,
+		Width:  *imgMaxWidth,
+		Height: *imgMaxHeight,
+		Pixels: *imgMaxPixels,
 	}
 
 	b := &bot{
-		Name:           "lasagnad",
-		MessageTimeout: 5 * time.Second,
-		Logger:         logger(*debug),
-		Slack:          slackClient(*authToken, *dumpWebsocketMessages),
-		dump: &imgdump{
-			S3:     s3.New(session.Must(session.NewSession())),
-			Bucket: *imgBucket,
-			Prefix: *imgPrefix,
-		},
+		Name:             "lasagnad",
+		MessageTimeout:   5 * time.Second,
+		Logger:           botLogger,
+		Slack:            slackClient(*authToken, *dumpWebsocketMessages),
+		Admins:           userSet(*authAdmins),
+		HTTP:             *policy.client(5 * time.Second),
+		Limits:           limits,
+		dump:             store,
+		Shuffle:          newShuffler(randomSeed()),
+		PinReaction:      reactionName(*slackPinReact),
+		SlackToken:       *authToken,
+		DeleteSlackFiles: *slackDeleteFile,
+		FetchPool:        newWorkerPool("fetch", *workerFetch, *workerFetchQueue),
+		OtherPool:        newWorkerPool("other", *workerOther, *workerOtherQueue),
+	}
+
+	if *indexPath != "" {
+		index, err := openIndex(*indexPath)
+		if err != nil {
+			log.Fatalf("uh oh, couldn't open the index: %s", err)
+		}
+		defer index.Close()
+		if index.NeedsReindex {
+			b.Logger.Warn("the index doesn't know which images were pinned before blobs existed, so they might get broken links. run `lasagnad reindex` to fix it")
+		}
+
+		b.dump = &indexedStore{imageStore: store, Index: index}
+	}
+
+	if *showWeightFavorites {
+		if *indexPath == "" {
+			log.Fatalf("invalid show config! weight-favorites needs an index")
+		}
+		b.WeightFavorites = true
+	}
+
+	// subcommands. these all run and exit without ever connecting to slack.
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "reindex":
+		indexed, ok := b.dump.(*indexedStore)
+		if !ok {
+			log.Fatalf("can't reindex! there's no index configured")
+		}
+
+		count, err := indexed.reindex(context.Background())
+		if err != nil {
+			log.Fatalf("reindex failed: %s", err)
+		}
+		b.Logger.WithField("count", count).Info("reindexed")
+		return
+	case "migrate-blobs":
+		migrator, ok := store.(blobMigrator)
+		if !ok {
+			log.Fatalf("can't migrate! this image store doesn't have blobs")
+		}
+
+		count, err := migrator.migrateBlobs(context.Background())
+		if err != nil {
+			log.Fatalf("blob migration failed: %s", err)
+		}
+		b.Logger.WithField("count", count).Info("migrated")
+		return
+	case "migrate-ids":
+		// go through the index if there is one, so it can keep up
+		migrator, ok := b.dump.(idMigrator)
+		if !ok {
+			log.Fatalf("can't migrate! this image store doesn't know how")
+		}
+
+		migrated, err := migrator.migrateIDs(context.Background())
+		if err != nil {
+			log.Fatalf("id migration failed after %d images: %s", len(migrated), err)
+		}
+		b.Logger.WithField("count", len(migrated)).Info("migrated")
+		return
+	case "migrate-names":
+		// like migrate-ids, go through the index so it can keep up
+		migrator, ok := b.dump.(nameMigrator)
+		if !ok {
+			log.Fatalf("can't migrate! this image store doesn't know how")
+		}
+
+		renamed, err := migrator.migrateNames(context.Background())
+		if err != nil {
+			log.Fatalf("name migration failed after %d images: %s", len(renamed), err)
+		}
+		b.Logger.WithField("count", len(renamed)).Info("migrated")
+		return
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
+
+	if local, isLocal := store.(*localdump); isLocal {
+		go serveLocalImages(b.Logger, *imgListenAddr, local)
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(b.Logger, *metricsAddr)
 	}
 
 	// try authing to slack before anything else happens. fail fast, baby!
@@ -81,17 +251,141 @@ func main() {
 		return
 	}
 
-	// gops. keep ShutdownCleanup on because this seems a little easier
-	if err := agent.Listen(agent.Options{ShutdownCleanup: true}); err != nil {
+	// gops. ShutdownCleanup would exit on an interrupt before in-flight messages
+	// are handled, so the agent gets closed by hand on the way out.
+	if err := agent.Listen(agent.Options{}); err != nil {
 		b.Logger.Error("exiting with a fatal error: ", err)
 	}
+	defer agent.Close()
+
+	// stop on SIGINT or SIGTERM. a second signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		b.Logger.WithField("signal", sig).Info("shutting down")
+		b.Stop()
+
+		sig = <-signals
+		b.Logger.WithField("signal", sig).Fatal("shutting down NOW")
+	}()
 
 	// the bot
-	if err := b.Run(); err != nil {
+	switch *slackTransport {
+	case "rtm":
+		err = b.Run(ctx)
+	case "events":
+		if *authSecret == "" {
+			b.Logger.Fatal("can't start! the events transport needs a signing secret")
+		}
+		err = b.Serve(ctx, *slackEventsAddr, *authSecret)
+	default:
+		b.Logger.Fatalf("can't start! unknown transport %q", *slackTransport)
+	}
+	if err != nil {
 		b.Logger.Error("exiting with a fatal error: ", err)
 	}
 }
 
+// build an imageStore from the [img] flags. exits if the config is invalid.
+func imageStoreFromFlags(logger logrus.FieldLogger) imageStore {
+	switch *imgStore {
+	case "s3":
+		if *imgBucket == "" {
+			log.Fatalf("invalid s3 bucket config! need a bucket")
+		}
+		var baseURL *url.URL
+		if *imgBaseURL != "" {
+			var err error
+			if baseURL, err = url.Parse(*imgBaseURL); err != nil {
+				log.Fatalf("invalid s3 url config! bad base url: %s", err)
+			}
+		}
+		if err := validS3URLConfig(*imgURLMode, *imgURLLifetime, baseURL); err != nil {
+			log.Fatalf("invalid s3 url config! %s", err)
+		}
+		acl := *imgACL
+		if acl == noACL {
+			acl = ""
+		}
+		client, err := s3Config{
+			Endpoint:        *imgEndpoint,
+			Region:          *imgRegion,
+			PathStyle:       *imgPathStyle,
+			AccessKeyID:     *imgAccessKeyID,
+			SecretAccessKey: *imgSecretAccessKey,
+		}.client()
+		if err != nil {
+			log.Fatalf("invalid s3 config! %s", err)
+		}
+		return &imgdump{
+			S3:          client,
+			Bucket:      *imgBucket,
+			Prefix:      *imgPrefix,
+			URLMode:     *imgURLMode,
+			URLLifetime: *imgURLLifetime,
+			BaseURL:     baseURL,
+			ACL:         acl,
+			Logger:      logger,
+		}
+	case "local":
+		if *imgDir == "" || *imgBaseURL == "" {
+			log.Fatalf("invalid local store config! need a dir and a base url")
+		}
+		baseURL, err := url.Parse(*imgBaseURL)
+		if err != nil {
+			log.Fatalf("invalid local store config! bad base url: %s", err)
+		}
+		return &localdump{
+			Dir:     *imgDir,
+			Prefix:  *imgPrefix,
+			BaseURL: baseURL,
+			Logger:  logger,
+		}
+	default:
+		log.Fatalf("invalid img config! unknown store %q", *imgStore)
+	}
+
+	return nil /*unreachable*/
+}
+
+// serve images from a localdump. the images are served under the path of the
+// dump's base url so that the urls it hands out resolve.
+func serveLocalImages(logger logrus.FieldLogger, addr string, dump *localdump) {
+	basePath := strings.TrimSuffix(dump.BaseURL.Path, "/")
+
+	mux := http.NewServeMux()
+	mux.Handle(basePath+"/", http.StripPrefix(basePath, dump))
+
+	logger.WithField("addr", addr).Info("serving local images")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Fatal("serving local images failed: ", err)
+	}
+}
+
+// parse a comma separated list of user ids into a set
+func userSet(userIDs string) map[string]bool {
+	users := make(map[string]bool)
+	for _, userID := range commaList(userIDs) {
+		users[userID] = true
+	}
+	return users
+}
+
+// split a comma separated list, ignoring whitespace and empty items
+func commaList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func slackClient(botToken string, debug bool) *slack.Client {
 	api := slack.New(botToken)
 	if debug {
@@ -126,10 +420,6 @@ func flagset(name string) *flag.FlagSet {
 	return set
 }
 
-// TODO(benl): handle panics
-// TODO(benl): track latency
-// TODO(benl): track uptime
-// TODO(benl): stats
 // TODO(benl): better command parsing (and maybe debug info into slack?)
 
 type bot struct {
@@ -143,10 +433,58 @@ type bot struct {
 	// the amount of time the bot is allowed to spend handling a single message.
 	MessageTimeout time.Duration
 
-	// the imgdump for storing pinned images
-	dump *imgdump
+	// the imageStore for storing pinned images
+	dump imageStore
+
+	// picks images for !show
+	Shuffle *shuffler
+
+	// if true, !show weights images by their favorites. only works with an
+	// indexedStore.
+	WeightFavorites bool
+
+	// the name of the reaction that pins an image, without colons. if empty,
+	// reactions are ignored.
+	PinReaction string
+
+	// images that have been reacted to and are waiting for a name
+	pending pendingPins
+
+	// held while changing aliases, since changing them means loading the whole
+	// alias map and saving it again.
+	aliasMu sync.Mutex
+
+	// the slack user ids of users that are allowed to unpin any image, not just
+	// the ones they uploaded.
+	Admins map[string]bool
+
+	// the pools that commands are handled on. commands in fetchCommands are
+	// handled on FetchPool and everything else is handled on OtherPool.
+	FetchPool *workerPool
+	OtherPool *workerPool
+
+	// messages that are still being handled or are waiting in a pool's queue
+	inflight sync.WaitGroup
+
+	// closed by Stop
+	stopping     chan struct{}
+	stoppingInit sync.Once
+	stopOnce     sync.Once
+
+	// the client used to fetch images. it should enforce a fetchPolicy.
+	HTTP http.Client
+
+	// the limits on fetched images
+	Limits imageLimits
+
+	// the token Slack is using. files uploaded to slack can only be downloaded
+	// with it.
+	SlackToken string
+
+	// if true, files uploaded to slack are deleted from slack once they're
+	// pinned.
+	DeleteSlackFiles bool
 
-	HTTP   http.Client
 	Slack  *slack.Client
 	Logger logrus.FieldLogger
 }
@@ -180,12 +518,29 @@ func (b *bot) TestAuth() error {
 
 // run this bot. any errors returned from Run can be considered fatal and should
 // probably terminate the program.
-func (b *bot) Run() error {
+//
+// Run returns nil after Stop is called, once it's disconnected from Slack and
+// every in-flight message has been handled or MessageTimeout has passed. every
+// message is handled with a context derived from ctx.
+func (b *bot) Run(ctx context.Context) error {
 	rtm := b.Slack.NewRTM()
 	go rtm.ManageConnection()
 
-	for message := range rtm.IncomingEvents {
-		log := b.Logger.WithField("request_id", uuid.New())
+	for {
+		var message slack.RTMEvent
+		select {
+		case <-b.stopped():
+			b.Logger.Info("stopping")
+			if err := rtm.Disconnect(); err != nil {
+				b.Logger.WithError(err).Warn("disconnect failed")
+			}
+			b.drain()
+			return nil
+		case message = <-rtm.IncomingEvents:
+		}
+
+		requestID := uuid.New().String()
+		log := b.Logger.WithField("request_id", requestID)
 
 		if rtmErr, isRtmIssue := message.Data.(*slack.UnmarshallingErrorEvent); isRtmIssue {
 			log.WithError(rtmErr).Error("slack RTM type error")
@@ -200,51 +555,177 @@ func (b *bot) Run() error {
 			log.Info("connected")
 		case *slack.LatencyReport:
 			log.WithField("latency", event.Value).Debug("latency report")
+			slackLatency.Set(event.Value.Seconds())
 		case *slack.Ping:
 			log.WithField("ping_id", event.ID).Debug("ping")
 		}
 
-		go b.handle(log, &message)
+		b.dispatch(ctx, log, requestID, &message)
 	}
-
-	return nil /*unreachable*/
 }
 
-var (
-	commandRe              = regexp.MustCompile(`^!(pin|show|list)\s*(.*)`)
-	validPinNameRe         = regexp.MustCompile(`[a-zA-Z0-9]`)
-	invalidPinNameResponse = fmt.Sprintf("you made an opps! that's not a valid pin name %s.", validPinNameRe.String())
-)
+// run this bot with the Events API instead of RTM. Slack POSTs events to
+// /slack/events on an HTTP server listening on addr and they're handled exactly
+// like messages that come in over RTM.
+//
+// like Run, any errors returned from Serve should be considered fatal, and
+// Serve returns nil once it's been stopped and drained.
+func (b *bot) Serve(ctx context.Context, addr, signingSecret string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/slack/events", &eventsHandler{
+		SigningSecret: signingSecret,
+		Logger:        b.Logger,
+		Handle: func(log logrus.FieldLogger, requestID string, event *slack.RTMEvent) {
+			b.dispatch(ctx, log, requestID, event)
+		},
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
 
-const (
-	pinUsage             = "opps! try `!pin LINK NAME` instead."
-	showUsage            = "opps, there's nothing to show. try `!show NAME`."
-	invalidURLResponse   = "you made an opps! that's not a valid URL."
-	pinExists            = "that pin already exists! pins are forever."
-	genericErrorResponse = "opps. something went wrong."
-)
+	errs := make(chan error, 1)
+	go func() {
+		b.Logger.WithField("addr", addr).Info("listening for events")
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-b.stopped():
+	}
 
-/// handle every incoming message in a goroutine
-func (b *bot) handle(log logrus.FieldLogger, rtmEvent *slack.RTMEvent) {
-	ctx, cancel := context.WithTimeout(context.Background(), b.MessageTimeout)
+	// stop accepting new events before waiting on the ones that are already
+	// being handled. Shutdown waits for requests that are in the middle of being
+	// acked, so everything that's getting handled has been dispatched by the
+	// time it returns.
+	b.Logger.Info("stopping")
+	shutdownCtx, cancel := context.WithTimeout(ctx, b.MessageTimeout)
 	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		b.Logger.WithError(err).Warn("shutting down the events server failed")
+	}
+	b.drain()
+	return nil
+}
+
+// stop handling new messages. Run and Serve return once in-flight messages
+// have been handled.
+func (b *bot) Stop() {
+	b.stopped()
+	b.stopOnce.Do(func() { close(b.stopping) })
+}
+
+// a channel that's closed when the bot is stopped.
+func (b *bot) stopped() <-chan struct{} {
+	b.stoppingInit.Do(func() { b.stopping = make(chan struct{}) })
+	return b.stopping
+}
+
+// queue a message or a pin reaction to be handled on a worker pool, keeping
+// track of it so that shutdown can wait for it to finish. anything that isn't a
+// command or a pin reaction is dropped right away, and if the pool's queue is
+// full the user gets told to try again later.
+//
+// time spent waiting in the queue counts against MessageTimeout.
+func (b *bot) dispatch(ctx context.Context, log logrus.FieldLogger, requestID string, event *slack.RTMEvent) {
+	var cmd string
+	var message *slack.MessageEvent
+	var handle func(ctx context.Context)
 
-	message, isMessage := rtmEvent.Data.(*slack.MessageEvent)
-	if !isMessage {
+	switch data := event.Data.(type) {
+	case *slack.MessageEvent:
+		var args []string
+		var isCommand bool
+		cmd, args, isCommand = parseCommand(data.Text)
+		if !isCommand {
+			log.Debug("message not matched")
+			return
+		}
+		message = data
+		handle = func(ctx context.Context) { b.handle(ctx, log, requestID, message, cmd, args) }
+	case *slack.ReactionAddedEvent:
+		if !b.isPinReaction(data) {
+			return
+		}
+		cmd = "reaction"
+		message = reactionMessage(data)
+		handle = func(ctx context.Context) { b.handleReaction(ctx, log, requestID, data) }
+	default:
 		return
 	}
 
-	bounds := commandRe.FindStringSubmatchIndex(message.Text)
-	if bounds == nil {
-		log.Debug("message not matched")
+	pool := b.OtherPool
+	if fetchCommands[cmd] {
+		pool = b.FetchPool
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.MessageTimeout)
+	b.inflight.Add(1)
+	queued := pool.submit(func() {
+		defer b.inflight.Done()
+		defer cancel()
+		handle(ctx)
+	})
+	if queued {
 		return
 	}
 
-	// bounds is an array of index pairs that's been flattened. the first pair
-	// (0, 1) is the range of the complete match, which will be the entire range
-	// of message.Text, the next pair (2, 3) is the range that contains the command,
-	// and the last pair (4, 5) is the range of the rest of the message.
-	cmd, args := message.Text[bounds[2]:bounds[3]], strings.Fields(message.Text[bounds[4]:])
+	defer cancel()
+	b.inflight.Done()
+	rejectedTotal.WithLabelValues(pool.Name).Inc()
+	log.WithFields(logrus.Fields{"cmd": cmd, "pool": pool.Name}).Warn("queue full")
+	b.reply(ctx, log, message, busyResponse)
+}
+
+// wait for every in-flight message to be handled, but give up after
+// MessageTimeout - by then every message should have timed out anyway. returns
+// false if it gave up.
+func (b *bot) drain() bool {
+	done := make(chan struct{})
+	go func() {
+		b.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		b.Logger.Info("drained")
+		return true
+	case <-time.After(b.MessageTimeout):
+		b.Logger.Warn("gave up waiting for messages to finish")
+		return false
+	}
+}
+
+var (
+	commandRe              = regexp.MustCompile(`^!(pin|unpin|show|list|alias|unalias|rename|merge|tag|fav)\s*(.*)`)
+	knownCommands          = map[string]bool{"pin": true, "unpin": true, "show": true, "list": true, "alias": true, "unalias": true, "rename": true, "merge": true, "tag": true, "fav": true}
+	fetchCommands          = map[string]bool{"pin": true}
+	invalidPinNameResponse = fmt.Sprintf("you made an opps! pin names are letters, numbers, emoji, - and _, and can be up to %d characters long. put a team in front like `team/name` if you want.", maxPinNameLength)
+)
+
+const (
+	pinUsage              = "opps! try `!pin LINK NAME` instead, or react to an image and then `!pin NAME`."
+	showUsage             = "opps, there's nothing to show. try `!show NAME`."
+	listUsage             = "opps! try `!list`, `!list page:N`, or `!list NAME page:N` instead."
+	unpinUsage            = "opps! try `!unpin NAME ID` instead. `!list NAME` shows ids."
+	aliasUsage            = "opps! try `!alias NEW EXISTING` instead."
+	unaliasUsage          = "opps! try `!unalias NAME` instead."
+	renameUsage           = "opps! try `!rename OLD NEW` instead."
+	mergeUsage            = "opps! try `!merge FROM INTO` instead."
+	tagUsage              = "opps! try `!tag NAME ID TAG...` instead. `!list NAME` shows ids."
+	favUsage              = "opps! try `!fav NAME ID` instead. `!list NAME` shows ids."
+	invalidTagResponse    = "you made an opps! tags are letters, numbers, - and _."
+	invalidURLResponse    = "you made an opps! that's not a valid URL."
+	pinExists             = "that pin already exists! pins are forever."
+	genericErrorResponse  = "opps. something went wrong."
+	busyResponse          = "i'm too busy right now, try again in a bit."
+	tooLargeResponse      = "that's too big, my dude. i only pin images up to %s."
+	partialMoveResponse   = "opps, something went wrong after moving %d images. `!merge %s %s` to finish up."
+	tooManyPixelsResponse = "that's way too many pixels, my dude. i only pin images up to %dx%d and %d pixels total."
+)
+
+/// handle a single incoming command. runs on a worker pool, see dispatch
+func (b *bot) handle(ctx context.Context, log logrus.FieldLogger, requestID string, message *slack.MessageEvent, cmd string, args []string) {
 	log = log.WithField("cmd", cmd)
 
 	// do an early timeout check before trying to do any work
@@ -253,28 +734,114 @@ func (b *bot) handle(log logrus.FieldLogger, rtmEvent *slack.RTMEvent) {
 		return
 	}
 
-	// setup request logging
+	// setup request logging and metrics. unknown commands all get lumped
+	// together so that random junk doesn't make new metrics.
+	metricsCmd := cmd
+	if !knownCommands[cmd] {
+		metricsCmd = "unknown"
+	}
 	startedAt := time.Now()
 	defer func() {
 		elapsed := time.Since(startedAt)
 		log.WithField("elapsed_ms", int64(elapsed/time.Millisecond)).Info("done")
+		commandsTotal.WithLabelValues(metricsCmd).Inc()
+		commandDuration.WithLabelValues(metricsCmd).Observe(elapsed.Seconds())
 	}()
 
-	// TODO(benl): catch panics here?
-	// TODO(benl): maybe the reply should include something about what happened if
-	// an error or panic bubbles up
+	var handler commandHandler
 	switch cmd {
 	case `pin`:
-		b.handlePin(ctx, log, message, args)
+		handler = b.handlePin
+	case `unpin`:
+		handler = b.handleUnpin
 	case `show`:
-		b.handleShow(ctx, log, message, args)
+		handler = b.handleShow
+	case `list`:
+		handler = b.handleList
+	case `alias`:
+		handler = b.handleAlias
+	case `unalias`:
+		handler = b.handleUnalias
+	case `rename`:
+		handler = b.handleRename
+	case `merge`:
+		handler = b.handleMerge
+	case `tag`:
+		handler = b.handleTag
+	case `fav`:
+		handler = b.handleFav
 	default:
 		log.WithField("cmd", cmd).Debug("unknown command")
 		b.reply(ctx, log, message, "opps i don't know that song")
+		return
 	}
+
+	b.runCommand(ctx, log, requestID, message, handler, args)
+}
+
+// split a message into a command and its args. returns false if the message
+// isn't a command.
+func parseCommand(text string) (string, []string, bool) {
+	bounds := commandRe.FindStringSubmatchIndex(text)
+	if bounds == nil {
+		return "", nil, false
+	}
+
+	// bounds is an array of index pairs that's been flattened. the first pair
+	// (0, 1) is the range of the complete match, which will be the entire range
+	// of message.Text, the next pair (2, 3) is the range that contains the command,
+	// and the last pair (4, 5) is the range of the rest of the message.
+	return text[bounds[2]:bounds[3]], strings.Fields(text[bounds[4]:]), true
+}
+
+// a commandHandler handles a single command. args are the whitespace separated
+// words of the message after the command.
+type commandHandler func(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string)
+
+// run a command handler, recovering from any panic it throws. a panic gets
+// logged with its stack and the user gets an error message with the request id
+// so that it's easy to find in the logs.
+func (b *bot) runCommand(ctx context.Context, log logrus.FieldLogger, requestID string, message *slack.MessageEvent, handler commandHandler, args []string) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		stack := make([]byte, 64<<10)
+		stack = stack[:runtime.Stack(stack, false)]
+
+		panicsTotal.Inc()
+		log.WithFields(logrus.Fields{
+			"panic": r,
+			"stack": string(stack),
+		}).Error("recovered from a panic")
+
+		b.reply(ctx, log, message, fmt.Sprintf("%s (request id: `%s`)", genericErrorResponse, requestID))
+	}()
+
+	handler(ctx, log, message, args)
 }
 
 func (b *bot) handlePin(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	// !pin NAME names an image that was just reacted to, or pins the file it was
+	// uploaded with
+	if len(args) == 1 {
+		if pending, ok := b.pending.take(message.Channel, message.User); ok {
+			args = []string{pending, args[0]}
+		} else {
+			file, err := b.messageFile(ctx, message)
+			if err != nil {
+				log.WithError(err).Error("finding uploaded file failed")
+				b.reply(ctx, log, message, genericErrorResponse)
+				return
+			}
+			if file != nil {
+				b.pinSlackFile(ctx, log, message, file, args[0])
+				return
+			}
+		}
+	}
 	if len(args) < 2 {
 		b.reply(ctx, log, message, pinUsage)
 		return
@@ -299,50 +866,180 @@ func (b *bot) handlePin(ctx context.Context, log logrus.FieldLogger, message *sl
 		b.reply(ctx, log, message, invalidURLResponse)
 		return
 	}
-	if !validPinNameRe.MatchString(name) {
-		log.WithField("pin_name", name).Debug("pin name invalid")
-		b.reply(ctx, log, message, invalidPinNameResponse)
+
+	// slack file permalinks are a page about the file, not the file
+	if fileID, ok := permalinkFileID(url); ok {
+		file, err := b.slackFile(ctx, fileID)
+		if err != nil {
+			log.WithError(err).WithField("file", fileID).Info("fetching file info failed")
+			b.reply(ctx, log, message, "i can't get at that file, my dude")
+			return
+		}
+		b.pinSlackFile(ctx, log, message, file, name)
+		return
+	}
+
+	name, ok := b.resolveName(ctx, log, message, name)
+	if !ok {
 		return
 	}
 
 	// TODO(benl): give fetch its own timeout, shorter than the total response one. child contexts!
-	imageBytes, filetype, err := fetchImageBytes(ctx, &b.HTTP, url, *imgMaxSizeBytes)
+	imageBytes, filetype, err := fetchImageBytes(ctx, &b.HTTP, url, b.Limits)
+	if _, ok := b.pin(ctx, log, message, name, url.String(), imageBytes, filetype, err); ok {
+		b.reply(ctx, log, message, "k")
+	}
+}
+
+// pin a file that was uploaded to slack. if DeleteSlackFiles is set, the file is
+// deleted from slack once it's safely pinned, as long as the person pinning it
+// uploaded it or is an admin.
+func (b *bot) pinSlackFile(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, file *slack.File, name string) {
+	log = log.WithField("file", file.ID)
+	name, ok := b.resolveName(ctx, log, message, name)
+	if !ok {
+		return
+	}
+
+	imageBytes, filetype, err := fetchSlackFile(ctx, &b.HTTP, file, b.SlackToken, b.Limits)
+	if _, ok := b.pin(ctx, log, message, name, file.Permalink, imageBytes, filetype, err); !ok {
+		return
+	}
+
+	if !b.DeleteSlackFiles || !(file.User == message.User || b.Admins[message.User]) {
+		b.reply(ctx, log, message, "k")
+		return
+	}
+	if err := b.Slack.DeleteFileContext(ctx, file.ID); err != nil {
+		// the image is pinned, so this isn't worth bothering anyone about
+		log.WithError(err).Warn("deleting file failed")
+		b.reply(ctx, log, message, "k")
+		return
+	}
+
+	log.Info("deleted file")
+	b.reply(ctx, log, message, "k, and i cleaned it out of slack")
+}
+
+// store a fetched image, replying to the message if fetching or storing it
+// failed. returns false if there was an error.
+func (b *bot) pin(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, name, originalURL string, imageBytes []byte, filetype string, err error) (*img, bool) {
+	fetchesTotal.WithLabelValues(fetchResult(err)).Inc()
+	if errors.Cause(err) == ErrTooLarge {
+		log.WithError(err).Debug("image too large")
+		b.reply(ctx, log, message, fmt.Sprintf(tooLargeResponse, humanBytes(b.Limits.Bytes)))
+		return nil, false
+	}
+	if errors.Cause(err) == ErrTooManyPixels {
+		log.WithError(err).Debug("image has too many pixels")
+		b.reply(ctx, log, message, fmt.Sprintf(tooManyPixelsResponse, b.Limits.Width, b.Limits.Height, b.Limits.Pixels))
+		return nil, false
+	}
 	if err == ErrBadResponseCode {
 		log.WithError(err).Debug("bad response")
 		b.reply(ctx, log, message, "i did not get a 200, my dude")
-		return
+		return nil, false
 	}
 	if err == ErrBadImage {
 		log.WithError(err).Debug("bad image")
 		b.reply(ctx, log, message, "i'm too dumb to parse that content, my dude")
-		return
+		return nil, false
+	}
+	if err == ErrForbiddenURL {
+		log.WithError(err).Info("forbidden url")
+		b.reply(ctx, log, message, "i'm not allowed to fetch that, my dude")
+		return nil, false
 	}
 	if err != nil {
 		log.WithError(err).Error("fetch failed")
 		b.reply(ctx, log, message, genericErrorResponse)
-		return
+		return nil, false
 	}
 
 	// TODO(benl): give upload its own timeout, shorter than the total response one. child contexts!
-	escapedURL := url.String()
-	uploader := message.Username
-	img, err := b.dump.add(ctx, name, filetype, imageBytes, map[string]*string{
+	uploader := message.User
+	metadata := map[string]*string{
 		"uploaded-by":  &uploader,
-		"original-url": &escapedURL,
-	})
+		"original-url": &originalURL,
+		"channel":      &message.Channel,
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(imageBytes)); err == nil {
+		width, height := strconv.Itoa(config.Width), strconv.Itoa(config.Height)
+		metadata["width"], metadata["height"] = &width, &height
+	}
+
+	img, err := b.dump.add(ctx, name, filetype, imageBytes, metadata)
 
 	if err != nil {
 		log.WithError(err).Error("upload failed")
 		b.reply(ctx, log, message, genericErrorResponse)
-		return
+		return nil, false
 	}
 
 	log.WithFields(logrus.Fields{
 		"name": img.Name,
-		"img":  hex.EncodeToString(img.ID[:]),
+		"img":  img.ID.String(),
 	}).Debug("uploaded")
 
-	b.reply(ctx, log, message, "k")
+	return img, true
+}
+
+func (b *bot) handleUnpin(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) != 2 {
+		b.reply(ctx, log, message, unpinUsage)
+		return
+	}
+	name, ok := b.resolveName(ctx, log, message, args[0])
+	if !ok {
+		return
+	}
+	idPrefix := strings.ToLower(args[1])
+	log = log.WithFields(logrus.Fields{"name": name, "id_prefix": idPrefix})
+
+	imgs, err := b.dump.list(ctx, name)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	matches := matchID(imgs, idPrefix)
+	if len(matches) == 0 {
+		b.reply(ctx, log, message, "there's nothing there with that id :(")
+		return
+	}
+	if len(matches) > 1 {
+		b.reply(ctx, log, message, "that id matches more than one image. give me more of it!")
+		return
+	}
+
+	img, err := b.dump.get(ctx, name, matches[0].ID)
+	if err != nil {
+		log.WithError(err).Error("fetching image failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	uploader := img.Metadata["uploaded-by"]
+	if !b.Admins[message.User] && (uploader == "" || uploader != message.User) {
+		log.WithField("uploaded_by", uploader).Info("unpin not allowed")
+		b.reply(ctx, log, message, "opps, you can only unpin your own images.")
+		return
+	}
+
+	if err := b.dump.delete(ctx, name, img.ID); err != nil {
+		log.WithError(err).Error("delete failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"img":         img.ID.String(),
+		"uploaded_by": uploader,
+		"deleted_by":  message.User,
+	}).Info("unpinned")
+
+	b.reply(ctx, log, message, "k, it's gone")
 }
 
 func (b *bot) handleShow(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
@@ -350,9 +1047,26 @@ func (b *bot) handleShow(ctx context.Context, log logrus.FieldLogger, message *s
 		b.reply(ctx, log, message, showUsage)
 		return
 	}
-	name := args[0]
 
-	imgs, err := b.dump.list(ctx, name)
+	// the bag to draw from. tags get a # so they never share a bag with a name.
+	var bag string
+	var imgs []img
+	var err error
+	if strings.HasPrefix(args[0], "#") {
+		tag, ok := b.tagName(ctx, log, message, args[0])
+		if !ok {
+			return
+		}
+		bag = "#" + tag
+		imgs, err = b.dump.tagged(ctx, tag)
+	} else {
+		name, ok := b.resolveName(ctx, log, message, args[0])
+		if !ok {
+			return
+		}
+		bag = name
+		imgs, err = b.dump.list(ctx, name)
+	}
 	if err != nil {
 		log.WithError(err).Error("listing images failed")
 		b.reply(ctx, log, message, genericErrorResponse)
@@ -364,10 +1078,585 @@ func (b *bot) handleShow(ctx context.Context, log logrus.FieldLogger, message *s
 		return
 	}
 
-	img := imgs[rand.Intn(len(imgs))]
+	weights, err := b.favoriteWeights(ctx, imgs)
+	if err != nil {
+		// not being able to weight images isn't worth failing over
+		log.WithError(err).Warn("counting favorites failed")
+	}
+
+	img := b.Shuffle.next(message.Channel, bag, imgs, weights)
 	b.reply(ctx, log, message, img.URL.String())
 }
 
+// an image comes up once per trip through a shuffle bag, plus once for every
+// time it's been favorited. returns nil if images aren't weighted.
+func (b *bot) favoriteWeights(ctx context.Context, imgs []img) (map[pinKey]int, error) {
+	indexed, ok := b.dump.(*indexedStore)
+	if !b.WeightFavorites || !ok {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, i := range imgs {
+		if !seen[i.Name] {
+			seen[i.Name] = true
+			names = append(names, i.Name)
+		}
+	}
+
+	weights, err := indexed.Index.favorites(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	for k, count := range weights {
+		weights[k] = count + 1
+	}
+	return weights, nil
+}
+
+// the number of lines of a listing to show per page.
+const listPageSize = 20
+
+// what goes in front of a page number in !list.
+const listPagePrefix = "page:"
+
+func (b *bot) handleList(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	// !list and !list NAME both take an optional trailing page:N. names can be
+	// all numbers, so a bare number is always a name.
+	page := 1
+	if len(args) > 0 && strings.HasPrefix(args[len(args)-1], listPagePrefix) {
+		n, err := strconv.Atoi(strings.TrimPrefix(args[len(args)-1], listPagePrefix))
+		if err != nil {
+			b.reply(ctx, log, message, listUsage)
+			return
+		}
+		page = n
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 || page < 1 {
+		b.reply(ctx, log, message, listUsage)
+		return
+	}
+
+	var lines []string
+	var more string
+	if len(args) == 0 {
+		names, err := b.dump.names(ctx)
+		if err != nil {
+			log.WithError(err).Error("listing names failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s (%d)", name.Name, name.Count))
+		}
+
+		aliases, err := b.dump.aliases(ctx)
+		if err != nil {
+			log.WithError(err).Error("loading aliases failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+		for _, alias := range sortedAliases(aliases) {
+			lines = append(lines, fmt.Sprintf("%s -> %s", alias, aliases[alias]))
+		}
+		more = "!list"
+	} else if strings.HasPrefix(args[0], "#") {
+		tag, ok := b.tagName(ctx, log, message, args[0])
+		if !ok {
+			return
+		}
+		imgs, err := b.dump.tagged(ctx, tag)
+		if err != nil {
+			log.WithError(err).Error("listing tagged images failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+
+		for _, img := range imgs {
+			lines = append(lines, fmt.Sprintf("%s %s %s", img.Name, shortID(img.ID), img.Filetype))
+		}
+		more = "!list #" + tag
+	} else {
+		name, ok := b.resolveName(ctx, log, message, args[0])
+		if !ok {
+			return
+		}
+		imgs, err := b.dump.list(ctx, name)
+		if err != nil {
+			log.WithError(err).Error("listing images failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+
+		for _, img := range imgs {
+			lines = append(lines, fmt.Sprintf("%s %s", shortID(img.ID), img.Filetype))
+		}
+		more = "!list " + name
+	}
+
+	if len(lines) == 0 {
+		b.reply(ctx, log, message, "there's nothing there :(")
+		return
+	}
+
+	lines, pages := paginate(lines, page, listPageSize)
+	if len(lines) == 0 {
+		b.reply(ctx, log, message, fmt.Sprintf("opps, there are only %d pages.", pages))
+		return
+	}
+
+	text := "```\n" + strings.Join(lines, "\n") + "\n```"
+	if page < pages {
+		text += fmt.Sprintf("\npage %d of %d. try `%s %s%d` for more.", page, pages, more, listPagePrefix, page+1)
+	}
+	b.reply(ctx, log, message, text)
+}
+
+// returns the lines on the given 1-indexed page and the total number of pages.
+// if page is past the end, no lines are returned.
+func paginate(lines []string, page, size int) ([]string, int) {
+	pages := (len(lines) + size - 1) / size
+	if page > pages {
+		return nil, pages
+	}
+
+	start := (page - 1) * size
+	end := start + size
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return lines[start:end], pages
+}
+
+// !alias NEW EXISTING makes NEW another name for EXISTING. NEW can't already
+// have images pinned under it, and EXISTING has to have images or be an alias
+// for something that does.
+func (b *bot) handleAlias(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) != 2 {
+		b.reply(ctx, log, message, aliasUsage)
+		return
+	}
+	alias, ok := b.pinName(ctx, log, message, args[0])
+	if !ok {
+		return
+	}
+	target, ok := b.pinName(ctx, log, message, args[1])
+	if !ok {
+		return
+	}
+	log = log.WithFields(logrus.Fields{"alias": alias, "target": target})
+
+	b.aliasMu.Lock()
+	defer b.aliasMu.Unlock()
+
+	aliases, err := b.dump.aliases(ctx)
+	if err != nil {
+		log.WithError(err).Error("loading aliases failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if existing, isAlias := aliases[alias]; isAlias {
+		b.reply(ctx, log, message, fmt.Sprintf("%s is already an alias for %s. `!unalias %s` first.", alias, existing, alias))
+		return
+	}
+
+	imgs, err := b.dump.list(ctx, alias)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if len(imgs) > 0 {
+		b.reply(ctx, log, message, fmt.Sprintf("there are already images pinned as %s, it can't be an alias.", alias))
+		return
+	}
+
+	aliases[alias] = target
+	resolved, err := resolveAlias(aliases, alias)
+	if err == ErrAliasCycle {
+		b.reply(ctx, log, message, "that would make a loop, my dude.")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("resolving alias failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	imgs, err = b.dump.list(ctx, resolved)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if len(imgs) == 0 {
+		b.reply(ctx, log, message, fmt.Sprintf("there's nothing pinned as %s :(", target))
+		return
+	}
+
+	if err := b.dump.saveAliases(ctx, aliases); err != nil {
+		log.WithError(err).Error("saving aliases failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	log.Info("aliased")
+	b.reply(ctx, log, message, fmt.Sprintf("k, %s is %s now", alias, target))
+}
+
+// !unalias NAME removes an alias. it doesn't touch any images.
+func (b *bot) handleUnalias(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) != 1 {
+		b.reply(ctx, log, message, unaliasUsage)
+		return
+	}
+	alias, ok := b.pinName(ctx, log, message, args[0])
+	if !ok {
+		return
+	}
+	log = log.WithField("alias", alias)
+
+	b.aliasMu.Lock()
+	defer b.aliasMu.Unlock()
+
+	aliases, err := b.dump.aliases(ctx)
+	if err != nil {
+		log.WithError(err).Error("loading aliases failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if _, isAlias := aliases[alias]; !isAlias {
+		b.reply(ctx, log, message, fmt.Sprintf("%s isn't an alias.", alias))
+		return
+	}
+
+	delete(aliases, alias)
+	if err := b.dump.saveAliases(ctx, aliases); err != nil {
+		log.WithError(err).Error("saving aliases failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	log.Info("unaliased")
+	b.reply(ctx, log, message, "k, it's gone")
+}
+
+// !tag NAME ID TAG... adds tags to an image. anyone can tag anything.
+func (b *bot) handleTag(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) < 3 {
+		b.reply(ctx, log, message, tagUsage)
+		return
+	}
+	name, ok := b.resolveName(ctx, log, message, args[0])
+	if !ok {
+		return
+	}
+	idPrefix := strings.ToLower(args[1])
+
+	var tags []string
+	for _, arg := range args[2:] {
+		tag, ok := b.tagName(ctx, log, message, arg)
+		if !ok {
+			return
+		}
+		tags = append(tags, tag)
+	}
+	log = log.WithFields(logrus.Fields{"name": name, "id_prefix": idPrefix, "tags": tags})
+
+	imgs, err := b.dump.list(ctx, name)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	matches := matchID(imgs, idPrefix)
+	if len(matches) == 0 {
+		b.reply(ctx, log, message, "there's nothing there with that id :(")
+		return
+	}
+	if len(matches) > 1 {
+		b.reply(ctx, log, message, "that id matches more than one image. give me more of it!")
+		return
+	}
+
+	allTags, err := b.dump.tag(ctx, name, matches[0].ID, tags)
+	if err == ErrTooManyTags {
+		b.reply(ctx, log, message, fmt.Sprintf("opps, images can only have %d tags.", maxTagsPerImage))
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("tagging failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	log.Info("tagged")
+	b.reply(ctx, log, message, fmt.Sprintf("k, %s %s is tagged #%s", name, shortID(matches[0].ID), strings.Join(allTags, " #")))
+}
+
+// !fav NAME ID favorites an image. with weight-favorites on, favorited images
+// come up more often in !show. favorites only live in the index, so this needs
+// one.
+func (b *bot) handleFav(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) != 2 {
+		b.reply(ctx, log, message, favUsage)
+		return
+	}
+
+	indexed, ok := b.dump.(*indexedStore)
+	if !ok {
+		b.reply(ctx, log, message, "opps, favorites need an index and there isn't one :(")
+		return
+	}
+
+	name, ok := b.resolveName(ctx, log, message, args[0])
+	if !ok {
+		return
+	}
+	idPrefix := strings.ToLower(args[1])
+	log = log.WithFields(logrus.Fields{"name": name, "id_prefix": idPrefix})
+
+	imgs, err := b.dump.list(ctx, name)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	matches := matchID(imgs, idPrefix)
+	if len(matches) == 0 {
+		b.reply(ctx, log, message, "there's nothing there with that id :(")
+		return
+	}
+	if len(matches) > 1 {
+		b.reply(ctx, log, message, "that id matches more than one image. give me more of it!")
+		return
+	}
+
+	count, err := indexed.Index.favorite(ctx, name, matches[0].ID, message.User)
+	if err != nil {
+		log.WithError(err).Error("favoriting failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	log.WithField("favorites", count).Info("favorited")
+	favorites := "favorites"
+	if count == 1 {
+		favorites = "favorite"
+	}
+	b.reply(ctx, log, message, fmt.Sprintf("k, %s %s has %d %s", name, shortID(matches[0].ID), count, favorites))
+}
+
+// !rename OLD NEW moves every image pinned as OLD to NEW, which can't have
+// anything pinned as it yet.
+func (b *bot) handleRename(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) != 2 {
+		b.reply(ctx, log, message, renameUsage)
+		return
+	}
+	b.moveName(ctx, log, message, args[0], args[1], false)
+}
+
+// !merge FROM INTO moves every image pinned as FROM to INTO, which can already
+// have images of its own. images that are already pinned as INTO are skipped.
+func (b *bot) handleMerge(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	if len(args) != 2 {
+		b.reply(ctx, log, message, mergeUsage)
+		return
+	}
+	b.moveName(ctx, log, message, args[0], args[1], true)
+}
+
+// move every image from one name to another. unless merge is set, nothing can
+// be pinned under the new name yet.
+//
+// images are moved one at a time by copying and then deleting the original, so
+// if a move gets interrupted partway through, some images are under the new
+// name and the rest are still under the old one. running it again as a merge
+// finishes the job: images that were already copied are spotted by their id
+// and aren't copied twice.
+//
+// only admins can move images that other people pinned.
+func (b *bot) moveName(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, fromName, toName string, merge bool) {
+	from, ok := b.pinName(ctx, log, message, fromName)
+	if !ok {
+		return
+	}
+	to, ok := b.pinName(ctx, log, message, toName)
+	if !ok {
+		return
+	}
+	log = log.WithFields(logrus.Fields{"from": from, "to": to})
+
+	// hold the alias lock for the whole move, so nothing can alias to either name
+	// while images are moving around.
+	b.aliasMu.Lock()
+	defer b.aliasMu.Unlock()
+
+	aliases, err := b.dump.aliases(ctx)
+	if err != nil {
+		log.WithError(err).Error("loading aliases failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if _, isAlias := aliases[from]; isAlias {
+		b.reply(ctx, log, message, fmt.Sprintf("%s is an alias. `!unalias %s` instead.", from, from))
+		return
+	}
+	if _, isAlias := aliases[to]; isAlias {
+		if !merge {
+			b.reply(ctx, log, message, fmt.Sprintf("%s is an alias. `!merge %s %s` if you want them all together.", to, from, to))
+			return
+		}
+		if to, err = resolveAlias(aliases, to); err != nil {
+			log.WithError(err).Error("resolving alias failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+	}
+	if from == to {
+		b.reply(ctx, log, message, "those are the same name, my dude.")
+		return
+	}
+
+	imgs, err := b.dump.list(ctx, from)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if len(imgs) == 0 {
+		b.reply(ctx, log, message, fmt.Sprintf("there's nothing pinned as %s :(", from))
+		return
+	}
+
+	existing, err := b.dump.list(ctx, to)
+	if err != nil {
+		log.WithError(err).Error("listing images failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+	if len(existing) > 0 && !merge {
+		b.reply(ctx, log, message, fmt.Sprintf("there are already images pinned as %s. `!merge %s %s` if you want them all together.", to, from, to))
+		return
+	}
+	alreadyThere := make(map[imgid]bool, len(existing))
+	for _, img := range existing {
+		alreadyThere[img.ID] = true
+	}
+
+	if !b.Admins[message.User] {
+		for _, listed := range imgs {
+			img, err := b.dump.get(ctx, from, listed.ID)
+			if err != nil {
+				log.WithError(err).Error("fetching image failed")
+				b.reply(ctx, log, message, genericErrorResponse)
+				return
+			}
+			if uploader := img.Metadata["uploaded-by"]; uploader == "" || uploader != message.User {
+				log.WithField("uploaded_by", uploader).Info("move not allowed")
+				b.reply(ctx, log, message, fmt.Sprintf("opps, you can only move your own images and someone else pinned something as %s.", from))
+				return
+			}
+		}
+	}
+
+	moved, skipped := 0, 0
+	for _, img := range imgs {
+		if alreadyThere[img.ID] {
+			skipped++
+		} else if _, err := b.dump.copy(ctx, from, to, img.ID); err != nil {
+			log.WithError(err).WithField("img", img.ID.String()).Error("copy failed")
+			b.reply(ctx, log, message, fmt.Sprintf(partialMoveResponse, moved, from, to))
+			return
+		}
+
+		if err := b.dump.delete(ctx, from, img.ID); err != nil && err != ErrNotFound {
+			log.WithError(err).WithField("img", img.ID.String()).Error("delete failed")
+			b.reply(ctx, log, message, fmt.Sprintf(partialMoveResponse, moved, from, to))
+			return
+		}
+		moved++
+	}
+
+	// aliases for the old name follow the images
+	retargeted := false
+	for alias, target := range aliases {
+		if target == from {
+			aliases[alias] = to
+			retargeted = true
+		}
+	}
+	if retargeted {
+		if err := b.dump.saveAliases(ctx, aliases); err != nil {
+			log.WithError(err).Error("saving aliases failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+	}
+
+	log.WithFields(logrus.Fields{"moved": moved, "skipped": skipped}).Info("moved")
+
+	text := fmt.Sprintf("k, moved %d images from %s to %s", moved, from, to)
+	if skipped > 0 {
+		text += fmt.Sprintf(". %d of them were already there", skipped)
+	}
+	b.reply(ctx, log, message, text)
+}
+
+// normalize a pin name from a message and follow it through any aliases,
+// replying to the message and returning false if that doesn't work out.
+func (b *bot) resolveName(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, name string) (string, bool) {
+	name, ok := b.pinName(ctx, log, message, name)
+	if !ok {
+		return "", false
+	}
+
+	aliases, err := b.dump.aliases(ctx)
+	if err != nil {
+		log.WithError(err).Error("loading aliases failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return "", false
+	}
+
+	resolved, err := resolveAlias(aliases, name)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("resolving alias failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return "", false
+	}
+	return resolved, true
+}
+
+// normalize a tag from a message, replying to the message and returning false
+// if it's not a valid tag.
+func (b *bot) tagName(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, tag string) (string, bool) {
+	normalized, err := normalizeTag(tag)
+	if err != nil {
+		log.WithField("tag", tag).Debug("tag invalid")
+		b.reply(ctx, log, message, invalidTagResponse)
+		return "", false
+	}
+	return normalized, true
+}
+
+// normalize a pin name from a message, replying to the message and returning
+// false if it's not a valid name.
+func (b *bot) pinName(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, name string) (string, bool) {
+	normalized, err := normalizePinName(name)
+	if err != nil {
+		log.WithField("pin_name", name).Debug("pin name invalid")
+		b.reply(ctx, log, message, invalidPinNameResponse)
+		return "", false
+	}
+	return normalized, true
+}
+
 // reply sends a message back to slack in reponse to something and logs if
 // there's an error.
 func (b *bot) reply(ctx context.Context, log logrus.FieldLogger, to *slack.MessageEvent, text string) {
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a fakeSlack is just enough of the Slack Web API to test the bot. it records
+// every message the bot posts and every file it deletes, and serves Messages
+// from history and Files as uploads.
+type fakeSlack struct {
+	mu       sync.Mutex
+	replies  []string
+	deleted  []string
+	Messages []slack.Message
+	Files    []slack.File
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/chat.postMessage":
+		f.mu.Lock()
+		f.replies = append(f.replies, r.Form.Get("text"))
+		f.mu.Unlock()
+		w.Write([]byte(`{"ok": true, "channel": "C1234", "ts": "1234.5678"}`))
+	case "/conversations.history", "/conversations.replies":
+		ts := r.Form.Get("latest")
+		var found []slack.Message
+		for _, m := range f.Messages {
+			if m.Timestamp == ts {
+				found = append(found, m)
+			}
+		}
+		if len(found) == 0 && r.URL.Path == "/conversations.replies" {
+			w.Write([]byte(`{"ok": false, "error": "thread_not_found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "messages": found})
+	case "/files.list":
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "files": f.Files})
+	case "/files.info":
+		for _, file := range f.Files {
+			if file.ID == r.Form.Get("file") {
+				json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "file": file})
+				return
+			}
+		}
+		w.Write([]byte(`{"ok": false, "error": "file_not_found"}`))
+	case "/files.delete":
+		f.mu.Lock()
+		f.deleted = append(f.deleted, r.Form.Get("file"))
+		f.mu.Unlock()
+		w.Write([]byte(`{"ok": true}`))
+	default:
+		w.Write([]byte(`{"ok": false, "error": "unknown_method"}`))
+	}
+}
+
+func (f *fakeSlack) Replies() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.replies...)
+}
+
+func (f *fakeSlack) Deleted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deleted...)
+}
+
+// a bot backed by a fake Slack and a localdump in a temp dir.
+func testBot(t *testing.T) (*bot, *fakeSlack, func()) {
+	dump, cleanupDump := testLocaldump(t)
+
+	fake := &fakeSlack{}
+	server := httptest.NewServer(fake)
+	oldAPI := slack.SLACK_API
+	slack.SLACK_API = server.URL + "/"
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	b := &bot{
+		Name:           "lasagnad",
+		MessageTimeout: 5 * time.Second,
+		Logger:         logger,
+		Slack:          slack.New("xoxb-garf"),
+		Limits:         testImageLimits,
+		dump:           dump,
+		Shuffle:        newShuffler(1),
+		FetchPool:      newWorkerPool("fetch", 1, 1),
+		OtherPool:      newWorkerPool("other", 1, 1),
+	}
+
+	return b, fake, func() {
+		slack.SLACK_API = oldAPI
+		server.Close()
+		cleanupDump()
+	}
+}
+
+func testMessage(user, text string) *slack.RTMEvent {
+	message := &slack.MessageEvent{}
+	message.Type = "message"
+	message.Channel = "C1234"
+	message.User = user
+	message.Text = text
+	return &slack.RTMEvent{Type: "message", Data: message}
+}
+
+// handle a message right away instead of dispatching it to a pool.
+func testHandle(ctx context.Context, b *bot, requestID string, event *slack.RTMEvent) {
+	message := event.Data.(*slack.MessageEvent)
+	cmd, args, isCommand := parseCommand(message.Text)
+	if !isCommand {
+		return
+	}
+	b.handle(ctx, b.Logger, requestID, message, cmd, args)
+}
+
+func TestRunCommandRecoversPanics(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	before := counterValue(t, panicsTotal)
+	message := testMessage("U1234", "!show garf").Data.(*slack.MessageEvent)
+	b.runCommand(context.Background(), b.Logger, "some-request-id", message, func(context.Context, logrus.FieldLogger, *slack.MessageEvent, []string) {
+		panic("lasagna")
+	}, nil)
+
+	assert.Equal(t, before+1, counterValue(t, panicsTotal))
+	require.Len(t, fake.Replies(), 1)
+	assert.Contains(t, fake.Replies()[0], genericErrorResponse)
+	assert.Contains(t, fake.Replies()[0], "some-request-id")
+}
+
+func TestHandleListAndUnpin(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	uploader := "U1234"
+	added, err := b.dump.add(ctx, "garf", "gif", []byte("a gif"), map[string]*string{"uploaded-by": &uploader})
+	require.NoError(t, err)
+
+	testHandle(ctx, b, "list", testMessage("U1234", "!list"))
+	testHandle(ctx, b, "list-garf", testMessage("U1234", "!list garf"))
+	testHandle(ctx, b, "unpin-other", testMessage("U5678", "!unpin garf "+shortID(added.ID)))
+	testHandle(ctx, b, "unpin", testMessage("U1234", "!unpin garf "+shortID(added.ID)))
+
+	replies := fake.Replies()
+	require.Len(t, replies, 4)
+	assert.Contains(t, replies[0], "garf (1)")
+	assert.Contains(t, replies[1], shortID(added.ID)+" gif")
+	assert.Contains(t, replies[2], "only unpin your own")
+	assert.Equal(t, "k, it's gone", replies[3])
+
+	imgs, err := b.dump.list(ctx, "garf")
+	require.NoError(t, err)
+	assert.Empty(t, imgs)
+}
+
+func TestHandleListPages(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < listPageSize+1; i++ {
+		_, err := b.dump.add(ctx, fmt.Sprintf("garf-%02d", i), "gif", []byte(fmt.Sprintf("gif %d", i)), nil)
+		require.NoError(t, err)
+	}
+	added, err := b.dump.add(ctx, "420", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	for _, text := range []string{
+		"!list",
+		"!list page:2",
+		"!list 420",
+		"!list 420 page:1",
+		"!list page:lasagna",
+		"!list page:0",
+	} {
+		testHandle(ctx, b, text, testMessage("U1234", text))
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 6)
+	assert.Contains(t, replies[0], "try `!list page:2` for more")
+	assert.Contains(t, replies[1], "garf-20 (1)")
+	assert.Contains(t, replies[2], shortID(added.ID)+" gif")
+	assert.Contains(t, replies[3], shortID(added.ID)+" gif")
+	assert.Equal(t, listUsage, replies[4])
+	assert.Equal(t, listUsage, replies[5])
+}
+
+func TestDrain(t *testing.T) {
+	b, _, cleanup := testBot(t)
+	defer cleanup()
+	b.MessageTimeout = 50 * time.Millisecond
+
+	b.inflight.Add(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.inflight.Done()
+	}()
+	assert.True(t, b.drain(), "should finish draining")
+
+	b.inflight.Add(1)
+	defer b.inflight.Done()
+	assert.False(t, b.drain(), "should give up draining")
+}
+
+func TestServeStops(t *testing.T) {
+	b, _, cleanup := testBot(t)
+	defer cleanup()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- b.Serve(context.Background(), "127.0.0.1:0", testSigningSecret)
+	}()
+	b.Stop()
+
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve never returned")
+	}
+}
+
+func TestDispatchBusy(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	// no workers and no queue means every command gets turned away
+	b.FetchPool = newWorkerPool("fetch", 0, 0)
+
+	b.dispatch(context.Background(), b.Logger, "pin", testMessage("U1234", "!pin <https://example.com/garf.gif> garf"))
+	b.dispatch(context.Background(), b.Logger, "not-a-command", testMessage("U1234", "garf"))
+	assert.True(t, b.drain(), "nothing should be in flight")
+
+	assert.Equal(t, []string{busyResponse}, fake.Replies())
+}
+
+func TestHandleNormalizesNames(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	garf, err := b.dump.add(ctx, "comics/garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	spaghetti, err := b.dump.add(ctx, "🍝", "gif", []byte("another gif"), nil)
+	require.NoError(t, err)
+
+	testHandle(ctx, b, "show", testMessage("U1234", "!show Comics/GARF"))
+	testHandle(ctx, b, "show-escape", testMessage("U1234", "!show ../../garf"))
+	testHandle(ctx, b, "pin-escape", testMessage("U1234", "!pin <https://example.com/garf.gif> ../garf"))
+	testHandle(ctx, b, "show-emoji", testMessage("U1234", "!show 🍝"))
+	testHandle(ctx, b, "show-shortcode", testMessage("U1234", "!show :spaghetti:"))
+
+	replies := fake.Replies()
+	require.Len(t, replies, 5)
+	assert.Equal(t, garf.URL.String(), replies[0])
+	assert.Equal(t, invalidPinNameResponse, replies[1])
+	assert.Equal(t, invalidPinNameResponse, replies[2])
+	assert.Equal(t, spaghetti.URL.String(), replies[3])
+	assert.Equal(t, replies[3], replies[4])
+}
+
+func TestHandleAlias(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	added, err := b.dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	for _, text := range []string{
+		"!alias garfield garf",
+		"!show garfield",
+		"!list garfield",
+		"!alias fat-cat garfield",
+		"!alias garf garfield",
+		"!alias garf fat-cat",
+		"!alias garfield odie",
+		"!alias nermal odie",
+		"!list",
+		"!unalias garfield",
+		"!show fat-cat",
+		"!unalias garfield",
+	} {
+		testHandle(ctx, b, text, testMessage("U1234", text))
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 12)
+	assert.Equal(t, "k, garfield is garf now", replies[0])
+	assert.Equal(t, added.URL.String(), replies[1])
+	assert.Contains(t, replies[2], shortID(added.ID))
+	assert.Equal(t, "k, fat-cat is garfield now", replies[3])
+	assert.Contains(t, replies[4], "already images pinned as garf")
+	assert.Contains(t, replies[5], "already images pinned as garf")
+	assert.Contains(t, replies[6], "already an alias for garf")
+	assert.Contains(t, replies[7], "nothing pinned as odie")
+	assert.Contains(t, replies[8], "garf (1)")
+	assert.Contains(t, replies[8], "fat-cat -> garfield")
+	assert.Contains(t, replies[8], "garfield -> garf")
+	assert.Equal(t, "k, it's gone", replies[9])
+	assert.Equal(t, "there's nothing there :(", replies[10])
+	assert.Equal(t, "garfield isn't an alias.", replies[11])
+}
+
+func TestHandleAliasCycle(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := b.dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	// aliases can only loop back on themselves through names that have no
+	// images, which the bot won't alias to, so write a loop by hand.
+	require.NoError(t, b.dump.saveAliases(ctx, map[string]string{"jon": "arbuckle", "arbuckle": "jon"}))
+
+	testHandle(ctx, b, "alias", testMessage("U1234", "!alias garfield jon"))
+	testHandle(ctx, b, "show", testMessage("U1234", "!show jon"))
+
+	replies := fake.Replies()
+	require.Len(t, replies, 2)
+	assert.Equal(t, "that would make a loop, my dude.", replies[0])
+	assert.Equal(t, genericErrorResponse, replies[1])
+}
+
+func TestHandleRenameAndMerge(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+	b.Admins = map[string]bool{"UADMIN": true}
+
+	ctx := context.Background()
+	jon, liz := "U1234", "U5678"
+	for i, name := range []string{"garf", "garf", "odie", "nermal", "nermal"} {
+		uploader := jon
+		if name == "odie" {
+			uploader = liz
+		}
+		_, err := b.dump.add(ctx, name, "gif", []byte{byte(i)}, map[string]*string{"uploaded-by": &uploader})
+		require.NoError(t, err)
+	}
+
+	// pretend a merge of nermal got interrupted after copying one image
+	nermals, err := b.dump.list(ctx, "nermal")
+	require.NoError(t, err)
+	_, err = b.dump.copy(ctx, "nermal", "garfield", nermals[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, b.dump.saveAliases(ctx, map[string]string{"fat-cat": "garf"}))
+
+	for _, msg := range []struct{ user, text string }{
+		{jon, "!rename garf garfield"},
+		{jon, "!rename garf nermal"},
+		{jon, "!merge garf garfield"},
+		{jon, "!merge odie garfield"},
+		{"UADMIN", "!merge odie garfield"},
+		{jon, "!merge nermal garfield"},
+		{jon, "!rename nermal garfield"},
+		{jon, "!rename garf garf"},
+		{jon, "!list"},
+	} {
+		testHandle(ctx, b, msg.text, testMessage(msg.user, msg.text))
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 9)
+	assert.Contains(t, replies[0], "already images pinned as garfield")
+	assert.Contains(t, replies[1], "already images pinned as nermal")
+	assert.Equal(t, "k, moved 2 images from garf to garfield", replies[2])
+	assert.Contains(t, replies[3], "only move your own")
+	assert.Equal(t, "k, moved 1 images from odie to garfield", replies[4])
+	assert.Equal(t, "k, moved 2 images from nermal to garfield. 1 of them were already there", replies[5])
+	assert.Equal(t, "there's nothing pinned as nermal :(", replies[6])
+	assert.Equal(t, "those are the same name, my dude.", replies[7])
+	assert.Contains(t, replies[8], "garfield (5)")
+	assert.Contains(t, replies[8], "fat-cat -> garfield", "aliases should follow renames")
+	assert.NotContains(t, replies[8], "garf (")
+	assert.NotContains(t, replies[8], "nermal (")
+}
+
+func TestHandleTag(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	garf, err := b.dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	odie, err := b.dump.add(ctx, "odie", "gif", []byte("another gif"), nil)
+	require.NoError(t, err)
+
+	for _, text := range []string{
+		"!tag garf " + shortID(garf.ID) + " #cats Orange",
+		"!tag odie " + shortID(odie.ID) + " cats",
+		"!tag odie " + shortID(odie.ID) + " 🐶",
+		"!tag odie ffffffff cats",
+		"!show #cats",
+		"!show #dogs",
+		"!list #cats",
+		"!tag garf",
+	} {
+		testHandle(ctx, b, text, testMessage("U1234", text))
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 8)
+	assert.Equal(t, "k, garf "+shortID(garf.ID)+" is tagged #cats #orange", replies[0])
+	assert.Equal(t, "k, odie "+shortID(odie.ID)+" is tagged #cats", replies[1])
+	assert.Equal(t, invalidTagResponse, replies[2])
+	assert.Equal(t, "there's nothing there with that id :(", replies[3])
+	assert.Contains(t, []string{garf.URL.String(), odie.URL.String()}, replies[4])
+	assert.Equal(t, "there's nothing there :(", replies[5])
+	assert.Contains(t, replies[6], "garf "+shortID(garf.ID)+" gif")
+	assert.Contains(t, replies[6], "odie "+shortID(odie.ID)+" gif")
+	assert.Equal(t, tagUsage, replies[7])
+}
+
+func TestHandleShowDoesNotRepeat(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	var urls []string
+	for n := 0; n < 5; n++ {
+		added, err := b.dump.add(ctx, "garf", "gif", []byte(fmt.Sprintf("gif %d", n)), nil)
+		require.NoError(t, err)
+		urls = append(urls, added.URL.String())
+	}
+
+	for n := 0; n < 5; n++ {
+		testHandle(ctx, b, "", testMessage("U1234", "!show garf"))
+	}
+	assert.ElementsMatch(t, urls, fake.Replies())
+}
+
+func TestHandleFav(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	garf, err := b.dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+
+	// no index, no favorites
+	testHandle(ctx, b, "", testMessage("U1234", "!fav garf "+shortID(garf.ID)))
+
+	indexed, cleanupIndex := testIndexedStore(t)
+	defer cleanupIndex()
+	b.dump = indexed
+	b.WeightFavorites = true
+
+	garf, err = b.dump.add(ctx, "garf", "gif", []byte("a gif"), nil)
+	require.NoError(t, err)
+	other, err := b.dump.add(ctx, "garf", "gif", []byte("another gif"), nil)
+	require.NoError(t, err)
+
+	for _, m := range []struct{ user, text string }{
+		{"U1", "!fav garf " + shortID(garf.ID)},
+		{"U2", "!fav garf " + shortID(garf.ID)},
+		{"U2", "!fav garf ffffffff"},
+		{"U2", "!fav garf"},
+	} {
+		testHandle(ctx, b, "", testMessage(m.user, m.text))
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 5)
+	assert.Equal(t, "opps, favorites need an index and there isn't one :(", replies[0])
+	assert.Equal(t, "k, garf "+shortID(garf.ID)+" has 1 favorite", replies[1])
+	assert.Equal(t, "k, garf "+shortID(garf.ID)+" has 2 favorites", replies[2])
+	assert.Equal(t, "there's nothing there with that id :(", replies[3])
+	assert.Equal(t, favUsage, replies[4])
+
+	weights, err := b.favoriteWeights(ctx, []img{*garf, *other})
+	require.NoError(t, err)
+	assert.Equal(t, map[pinKey]int{{"garf", garf.ID}: 3}, weights)
+}
+
+func TestHandlePinReaction(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+	b.PinReaction = "pushpin"
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16))))
+	server := testImageServer(buf.Bytes(), false)
+	defer server.Close()
+
+	withImage, withoutImage := slack.Message{}, slack.Message{}
+	withImage.Timestamp, withImage.Text = "1111.0001", "look at this <"+server.URL+"/garf.png>"
+	withoutImage.Timestamp, withoutImage.Text = "1111.0002", "garf is great"
+	fake.Messages = []slack.Message{withImage, withoutImage}
+
+	react := func(user, reaction, ts string) *slack.RTMEvent {
+		event := &slack.ReactionAddedEvent{Type: "reaction_added", User: user, Reaction: reaction}
+		event.Item.Type, event.Item.Channel, event.Item.Timestamp = "message", "C1234", ts
+		return &slack.RTMEvent{Type: "reaction_added", Data: event}
+	}
+
+	ctx := context.Background()
+	for _, event := range []*slack.RTMEvent{
+		react("U1234", "heart", withImage.Timestamp),
+		react("U1234", "pushpin", withoutImage.Timestamp),
+		react("U1234", "pushpin", "9999.9999"),
+		react("U1234", "pushpin", withImage.Timestamp),
+		// someone else naming it doesn't count
+		testMessage("U5678", "!pin garf"),
+		testMessage("U1234", "!pin garf"),
+		testMessage("U1234", "!pin odie"),
+	} {
+		b.dispatch(ctx, b.Logger, "", event)
+		require.True(t, b.drain())
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 5)
+	assert.Equal(t, "there's nothing in there i can pin :(", replies[0])
+	assert.Contains(t, replies[1], "what should i pin that as?")
+	assert.Equal(t, pinUsage, replies[2])
+	assert.Equal(t, "k", replies[3])
+	assert.Equal(t, pinUsage, replies[4], "a reaction only pins once")
+
+	imgs, err := b.dump.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	assert.Equal(t, "png", imgs[0].Filetype)
+}
+
+func TestHandlePinReactionSlackFile(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+	b.PinReaction = "pushpin"
+	b.SlackToken = "xoxb-garf"
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16))))
+	server := testImageServer(buf.Bytes(), false)
+	defer server.Close()
+
+	var sent []*http.Request
+	b.HTTP = *testRedirectingClient(server.URL, &sent)
+
+	// an image uploaded straight to slack. the client doesn't decode the files
+	// on a file_share message, so it doesn't have a File.
+	upload := slack.Message{}
+	upload.Timestamp, upload.SubType, upload.User = "1355517523.000005", "file_share", "U5678"
+	fake.Messages = []slack.Message{upload}
+	fake.Files = []slack.File{{
+		ID:         "F1234",
+		User:       "U5678",
+		URLPrivate: "https://files.slack.com/files-pri/T1234-F1234/garf.png",
+		Permalink:  "https://garf.slack.com/files/U5678/F1234/garf.png",
+	}}
+
+	react := &slack.ReactionAddedEvent{Type: "reaction_added", User: "U1234", Reaction: "pushpin"}
+	react.Item.Type, react.Item.Channel, react.Item.Timestamp = "message", "C1234", upload.Timestamp
+
+	ctx := context.Background()
+	for _, event := range []*slack.RTMEvent{
+		{Type: "reaction_added", Data: react},
+		testMessage("U1234", "!pin garf"),
+	} {
+		b.dispatch(ctx, b.Logger, "", event)
+		require.True(t, b.drain())
+	}
+
+	replies := fake.Replies()
+	require.Len(t, replies, 2)
+	assert.Contains(t, replies[0], "what should i pin that as?")
+	assert.Equal(t, "k", replies[1])
+
+	require.NotEmpty(t, sent)
+	for _, req := range sent {
+		assert.Equal(t, "Bearer xoxb-garf", req.Header.Get("Authorization"))
+	}
+
+	imgs, err := b.dump.list(ctx, "garf")
+	require.NoError(t, err)
+	require.Len(t, imgs, 1)
+	pinned, err := b.dump.get(ctx, "garf", imgs[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "https://garf.slack.com/files/U5678/F1234/garf.png", pinned.Metadata["original-url"])
+}
+
+func TestHandlePinSlackFile(t *testing.T) {
+	b, fake, cleanup := testBot(t)
+	defer cleanup()
+	b.SlackToken = "xoxb-garf"
+	b.DeleteSlackFiles = true
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16))))
+	server := testImageServer(buf.Bytes(), false)
+	defer server.Close()
+
+	var sent []*http.Request
+	b.HTTP = *testRedirectingClient(server.URL, &sent)
+
+	fake.Files = []slack.File{{
+		ID:         "F1234",
+		User:       "U1234",
+		URLPrivate: "https://files.slack.com/files-pri/T1234-F1234/garf.png",
+		Permalink:  "https://garf.slack.com/files/U1234/F1234/garf.png",
+	}}
+
+	upload := testMessage("U1234", "!pin garf")
+	upload.Data.(*slack.MessageEvent).SubType = "file_share"
+	upload.Data.(*slack.MessageEvent).Timestamp = "1355517523.000005"
+
+	ctx := context.Background()
+	for _, event := range []*slack.RTMEvent{
+		upload,
+		// someone else pinning a file doesn't delete it
+		testMessage("U5678", "!pin <https://garf.slack.com/files/U1234/F1234/garf.png> odie"),
+		testMessage("U5678", "!pin <https://garf.slack.com/files/U1234/F9999/nope.png> odie"),
+	} {
+		testHandle(ctx, b, "", event)
+	}
+
+	assert.Equal(t, []string{
+		"k, and i cleaned it out of slack",
+		"k",
+		"i can't get at that file, my dude",
+	}, fake.Replies())
+	assert.Equal(t, []string{"F1234"}, fake.Deleted())
+
+	for _, req := range sent {
+		assert.Equal(t, "Bearer xoxb-garf", req.Header.Get("Authorization"))
+	}
+
+	for _, name := range []string{"garf", "odie"} {
+		imgs, err := b.dump.list(ctx, name)
+		require.NoError(t, err)
+		require.Len(t, imgs, 1, name)
+
+		pinned, err := b.dump.get(ctx, name, imgs[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, "https://garf.slack.com/files/U1234/F1234/garf.png", pinned.Metadata["original-url"])
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "lasagnad"
+
+// the time the process started, for tracking uptime
+var processStartedAt = time.Now()
+
+var (
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_total",
+		Help:      "The number of commands handled, by command.",
+	}, []string{"cmd"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "How long it took to handle a command, by command.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"cmd"})
+
+	rejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rejected_commands_total",
+		Help:      "The number of commands turned away because a worker pool's queue was full, by pool.",
+	}, []string{"pool"})
+
+	panicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "panics_total",
+		Help:      "The number of panics recovered while handling commands.",
+	})
+
+	fetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_fetches_total",
+		Help:      "The number of images fetched, by result.",
+	}, []string{"result"})
+
+	s3RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_duration_seconds",
+		Help:      "How long S3 requests took, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	blobWritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blob_writes_total",
+		Help:      "The number of images added, by whether their blob was uploaded or skipped because it already existed.",
+	}, []string{"result"})
+
+	blobsCollectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blobs_collected_total",
+		Help:      "The number of blobs deleted because nothing referred to them anymore.",
+	})
+
+	slackLatency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "slack_rtm_latency_seconds",
+		Help:      "The most recent latency reported by the Slack RTM API.",
+	})
+
+	uptime = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "uptime_seconds",
+		Help:      "How long lasagnad has been running.",
+	}, func() float64 {
+		return time.Since(processStartedAt).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		commandsTotal,
+		commandDuration,
+		rejectedTotal,
+		panicsTotal,
+		fetchesTotal,
+		s3RequestDuration,
+		blobWritesTotal,
+		blobsCollectedTotal,
+		slackLatency,
+		uptime,
+	)
+}
+
+// the result label for an image fetch
+func fetchResult(err error) string {
+	switch errors.Cause(err) {
+	case nil:
+		return "ok"
+	case ErrTooLarge:
+		return "too_large"
+	case ErrBadResponseCode:
+		return "bad_response_code"
+	case ErrTooManyPixels:
+		return "too_many_pixels"
+	case ErrBadImage:
+		return "bad_image"
+	case ErrForbiddenURL:
+		return "forbidden"
+	default:
+		return "error"
+	}
+}
+
+// the result label for adding an image
+func blobWriteResult(uploaded bool) string {
+	if uploaded {
+		return "uploaded"
+	}
+	return "skipped"
+}
+
+// observe how long an S3 request that started at startedAt took.
+func observeS3(op string, startedAt time.Time) {
+	s3RequestDuration.WithLabelValues(op).Observe(time.Since(startedAt).Seconds())
+}
+
+// serve metrics in the Prometheus format at /metrics
+func serveMetrics(logger logrus.FieldLogger, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.WithField("addr", addr).Info("serving metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Fatal("serving metrics failed: ", err)
+	}
+}
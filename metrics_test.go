@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the current value of a counter.
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m dto.Metric
+	require.NoError(t, counter.Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestFetchResult(t *testing.T) {
+	tcs := []struct {
+		err    error
+		result string
+	}{
+		{err: nil, result: "ok"},
+		{err: ErrTooLarge, result: "too_large"},
+		{err: &sizeError{Size: 2048, Limit: 1024}, result: "too_large"},
+		{err: errors.Wrap(ErrTooManyPixels, "50000x50000"), result: "too_many_pixels"},
+		{err: ErrBadResponseCode, result: "bad_response_code"},
+		{err: ErrBadImage, result: "bad_image"},
+		{err: ErrForbiddenURL, result: "forbidden"},
+		{err: fmt.Errorf("lasagna"), result: "error"},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.result, fetchResult(tc.err), "%v: wrong result", tc.err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// pin names are what people type to find an image again, and they end up in
+// every image's key, so they're pretty restricted.
+//
+// a name is made of one or two segments separated by a /, like garf or
+// comics/garf. a two segment name lives in a namespace - usually a team - and
+// the namespace is a real segment of the key:
+//
+//	<prefix>/comics/garf/<image_sha256>.<filetype>
+//
+// segments are letters, numbers, emoji, - and _, in any script, and always
+// start with a letter, a number or an emoji, so there's no way to sneak a . or
+// .. into a key. names are case insensitive and are normalized before they're
+// checked, so café, CAFÉ and a café with a combining accent are all the same
+// name, and so are 🍝 and :spaghetti:.
+//
+// anything that isn't a lowercase ASCII letter, a number, - or _ is percent
+// encoded in keys. see encodePinName.
+//
+// blobs can't be the first segment of a name, since that's where image bytes
+// live. see blobs.go
+const (
+	maxPinNameLength   = 64
+	maxPinNameSegments = 2
+)
+
+// ErrInvalidPinName is returned from an imageStore when it's handed a name
+// that isn't a valid pin name.
+var ErrInvalidPinName = fmt.Errorf("imgdump: invalid pin name")
+
+// slack sends emoji in messages as :shortcodes:, even if someone typed the
+// actual emoji
+var shortcodeRe = regexp.MustCompile(`:[a-z0-9_+'-]+:`)
+
+const (
+	zeroWidthJoiner = '\u200d'
+	textVariation   = '\ufe0e'
+	emojiVariation  = '\ufe0f'
+)
+
+// normalize a pin name that came from a person. returns ErrInvalidPinName if
+// the name isn't valid, even after normalizing.
+func normalizePinName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidPinName
+	}
+
+	name = foldPinName(expandShortcodes(name))
+	if !validPinName(name) {
+		return "", ErrInvalidPinName
+	}
+	return name, nil
+}
+
+// true if name is a valid, normalized pin name.
+func validPinName(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
+	}
+	if length := utf8.RuneCountInString(name); length == 0 || length > maxPinNameLength {
+		return false
+	}
+	if foldPinName(name) != name {
+		return false
+	}
+
+	segments := strings.Split(name, "/")
+	if len(segments) > maxPinNameSegments || segments[0] == blobsDir {
+		return false
+	}
+	for _, segment := range segments {
+		if !validPinNameSegment(segment) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validPinNameSegment(segment string) bool {
+	for i, r := range segment {
+		if i == 0 && !(unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.So, r)) {
+			return false
+		}
+
+		switch {
+		case r == '-' || r == '_':
+		case unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r):
+		// emoji, skin tone modifiers, and the joiner that glues emoji together into
+		// families and professions and so on
+		case unicode.Is(unicode.So, r) || unicode.Is(unicode.Sk, r) || r == zeroWidthJoiner:
+		default:
+			return false
+		}
+	}
+	return segment != ""
+}
+
+// replace every :shortcode: slack knows about with the emoji it stands for.
+// shortcodes that aren't emoji, like custom emoji, are left alone.
+func expandShortcodes(name string) string {
+	return shortcodeRe.ReplaceAllStringFunc(name, func(shortcode string) string {
+		if e, ok := emojiShortcodes[shortcode]; ok {
+			return e
+		}
+		return shortcode
+	})
+}
+
+// case fold and NFC normalize a name. variation selectors are dropped, since
+// whether an emoji has one or not depends on who typed it and how.
+func foldPinName(name string) string {
+	// Casers aren't safe to share, so make a new one every time
+	name = cases.Fold().String(norm.NFC.String(name))
+	name = strings.Map(func(r rune) rune {
+		if r == textVariation || r == emojiVariation {
+			return -1
+		}
+		return r
+	}, name)
+	return norm.NFC.String(name)
+}
+
+// encode a valid pin name for use in a key. lowercase ASCII letters, numbers,
+// - and _ are left alone, so plain ASCII names look just like they did before
+// names could be unicode. everything else is percent encoded as UTF-8, so
+// keys don't depend on how S3, a filesystem, or a URL handle unicode.
+func encodePinName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decode a pin name from a key. returns ErrInvalidPinName if what's in the key
+// doesn't decode to a valid pin name.
+func decodePinName(encoded string) (string, error) {
+	name, err := url.PathUnescape(encoded)
+	if err != nil || !validPinName(name) || encodePinName(name) != encoded {
+		return "", ErrInvalidPinName
+	}
+	return name, nil
+}
+
+// a nameDir is a directory under a store's prefix that has images in it. Dir
+// is the name the way it is in keys, which might not decode to a valid pin name
+// if it was pinned before names were normalized.
+type nameDir struct {
+	Dir   string
+	Count int
+}
+
+// decode the names of a store's image directories. older versions of lasagnad
+// would pin under just about any name, so directories that don't decode get
+// logged and skipped instead of failing the whole listing. see nameMigrator.
+func decodeNameDirs(log logrus.FieldLogger, dirs []nameDir) []nameCount {
+	names := make([]nameCount, 0, len(dirs))
+	for _, dir := range dirs {
+		name, err := decodePinName(dir.Dir)
+		if err != nil {
+			log.WithFields(logrus.Fields{"key": dir.Dir, "count": dir.Count}).Warn("skipping images with an invalid name. run `lasagnad migrate-names` to fix it")
+			continue
+		}
+		names = append(names, nameCount{Name: name, Count: dir.Count})
+	}
+
+	// stores list keys in byte order, but encoded names don't sort like decoded
+	// ones do.
+	sort.Slice(names, func(i, j int) bool { return names[i].Name < names[j].Name })
+	return names
+}
+
+// the logger for a store, which is logrus's standard logger if it doesn't have
+// one.
+func storeLogger(log logrus.FieldLogger) logrus.FieldLogger {
+	if log == nil {
+		return logrus.StandardLogger()
+	}
+	return log
+}
+
+// a renamedPin is an image that migrate-names copied to a normalized name.
+type renamedPin struct {
+	From string
+	To   string
+	ID   imgid
+}
+
+// a nameMigrator is an imageStore that can fix images pinned under names that
+// aren't valid anymore.
+type nameMigrator interface {
+	// copy every image under a name that isn't normalized, like Garf, to the
+	// name it normalizes to, keeping its metadata and tags, and return every
+	// image that got copied. like migrateIDs, the old images are left where they
+	// are for the sake of old urls, but they're marked as migrated and aren't
+	// listed anymore. names that don't normalize to anything valid are logged
+	// and left alone. running it twice is fine.
+	migrateNames(ctx context.Context) ([]renamedPin, error)
+}
+
+// copy the images in every directory that doesn't decode to a valid name to
+// the name it normalizes to. stores handle copying the images in a single
+// directory and marking them as migrated.
+func migrateStoreNames(ctx context.Context, log logrus.FieldLogger, dirs []nameDir, rename func(ctx context.Context, dir, to string) ([]imgid, error)) ([]renamedPin, error) {
+	var renamed []renamedPin
+	for _, dir := range dirs {
+		if _, err := decodePinName(dir.Dir); err == nil {
+			continue
+		}
+
+		to, err := normalizePinName(dir.Dir)
+		if err != nil {
+			log.WithField("key", dir.Dir).Warn("can't migrate images with a name that doesn't normalize to a valid pin name")
+			continue
+		}
+
+		ids, err := rename(ctx, dir.Dir, to)
+		for _, id := range ids {
+			renamed = append(renamed, renamedPin{From: dir.Dir, To: to, ID: id})
+		}
+		if err != nil {
+			return renamed, errors.Wrap(err, fmt.Sprintf("imgdump: migrating %q failed", dir.Dir))
+		}
+	}
+	return renamed, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePinName(t *testing.T) {
+	tcs := []struct {
+		name       string
+		normalized string
+		valid      bool
+	}{
+		{name: "garf", normalized: "garf", valid: true},
+		{name: "GARF", normalized: "garf", valid: true},
+		{name: "garf_2", normalized: "garf_2", valid: true},
+		{name: "jon-arbuckle", normalized: "jon-arbuckle", valid: true},
+		{name: "1989", normalized: "1989", valid: true},
+		{name: "comics/garf", normalized: "comics/garf", valid: true},
+		{name: "Comics/Garf", normalized: "comics/garf", valid: true},
+		{name: strings.Repeat("a", maxPinNameLength), normalized: strings.Repeat("a", maxPinNameLength), valid: true},
+
+		// unicode
+		{name: "café", normalized: "café", valid: true},
+		{name: "CAFÉ", normalized: "café", valid: true},
+		{name: "cafe\u0301", normalized: "café", valid: true},
+		{name: "Straße", normalized: "strasse", valid: true},
+		{name: "ラザニア", normalized: "ラザニア", valid: true},
+		{name: "comics/ガーフィールド", normalized: "comics/ガーフィールド", valid: true},
+		{name: strings.Repeat("é", maxPinNameLength), normalized: strings.Repeat("é", maxPinNameLength), valid: true},
+		{name: strings.Repeat("é", maxPinNameLength+1)},
+
+		// emoji and shortcodes
+		{name: "🍝", normalized: "🍝", valid: true},
+		{name: ":spaghetti:", normalized: "🍝", valid: true},
+		{name: "garf:spaghetti:", normalized: "garf🍝", valid: true},
+		{name: "comics/:spaghetti:", normalized: "comics/🍝", valid: true},
+		{name: "❤️", normalized: "❤", valid: true},
+		{name: "❤", normalized: "❤", valid: true},
+		{name: ":heart:", normalized: "❤", valid: true},
+		{name: ":thumbsup::skin-tone-2:", normalized: "👍🏻", valid: true},
+		{name: "👩\u200d🍳", normalized: "👩\u200d🍳", valid: true},
+		{name: ":partyparrot:"},
+		{name: "\u200d🍳"},
+
+		// invisible and control characters
+		{name: "garf\u200b"},
+		{name: "\u202egarf"},
+		{name: "garf\u00a0"},
+		{name: "\xff\xfe"},
+
+		{name: ""},
+		{name: strings.Repeat("a", maxPinNameLength+1)},
+		{name: "comics/garf/extra"},
+		{name: "/garf"},
+		{name: "garf/"},
+		{name: "comics//garf"},
+		{name: "-garf"},
+		{name: "_garf"},
+		{name: "garf!"},
+		{name: "garf field"},
+		{name: "garf.gif"},
+		{name: "garf\n"},
+		{name: "garf\x00"},
+
+		// all the ways to climb out of the prefix
+		{name: "."},
+		{name: ".."},
+		{name: "../garf"},
+		{name: "../../other-prefix"},
+		{name: "garf/.."},
+		{name: "garf/../../mindy"},
+		{name: "./garf"},
+		{name: ".garf"},
+		{name: "..\\garf"},
+		{name: "garf\\..\\mindy"},
+		{name: "%2e%2e/garf"},
+		{name: "~/garf"},
+
+		// reserved for image blobs
+		{name: "blobs"},
+		{name: "blobs/garf"},
+	}
+
+	for _, tc := range tcs {
+		normalized, err := normalizePinName(tc.name)
+		if tc.valid {
+			assert.NoError(t, err, "%q: should be valid", tc.name)
+			assert.Equal(t, tc.normalized, normalized, "%q: wrong normalized name", tc.name)
+		} else {
+			assert.Equal(t, ErrInvalidPinName, err, "%q: should be invalid", tc.name)
+		}
+	}
+}
+
+func TestEncodePinName(t *testing.T) {
+	tcs := []struct {
+		name    string
+		encoded string
+	}{
+		{name: "garf", encoded: "garf"},
+		{name: "comics/garf_2-b", encoded: "comics/garf_2-b"},
+		{name: "café", encoded: "caf%C3%A9"},
+		{name: "🍝", encoded: "%F0%9F%8D%9D"},
+		{name: "comics/🍝", encoded: "comics/%F0%9F%8D%9D"},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.encoded, encodePinName(tc.name), "%q: wrong encoding", tc.name)
+
+		decoded, err := decodePinName(tc.encoded)
+		assert.NoError(t, err, "%q: should decode", tc.encoded)
+		assert.Equal(t, tc.name, decoded, "%q: wrong decoding", tc.encoded)
+	}
+
+	for _, encoded := range []string{"GARF", "caf%c3%a9", "caf%C3", "%2E%2E", "..", "caf%C3%A9%2Fgarf", "a/b/c"} {
+		_, err := decodePinName(encoded)
+		assert.Equal(t, ErrInvalidPinName, err, "%q: shouldn't decode", encoded)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+// a workerPool runs jobs on a fixed number of goroutines. jobs wait in a queue
+// of fixed size until there's a worker free to run them, and new jobs are
+// turned away when the queue is full.
+type workerPool struct {
+	Name string
+	jobs chan func()
+}
+
+// start a pool with the given number of workers and room for queueSize jobs
+// to wait. workers run for as long as the process does.
+func newWorkerPool(name string, workers, queueSize int) *workerPool {
+	p := &workerPool{
+		Name: name,
+		jobs: make(chan func(), queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// queue a job. returns false without queueing anything if the queue is full.
+func (p *workerPool) submit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		job()
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolQueueFull(t *testing.T) {
+	pool := newWorkerPool("test", 1, 1)
+
+	// block the only worker, then fill the queue
+	started, unblock := make(chan struct{}), make(chan struct{})
+	assert.True(t, pool.submit(func() {
+		close(started)
+		<-unblock
+	}))
+	<-started
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	assert.True(t, pool.submit(wg.Done), "should queue a job")
+	assert.False(t, pool.submit(func() {}), "should reject a job with a full queue")
+
+	close(unblock)
+	wg.Wait()
+	assert.True(t, pool.submit(func() {}), "should accept jobs after the queue drains")
+}
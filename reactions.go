@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// pinning by reaction. when someone reacts to a message with the configured pin
+// reaction, lasagnad finds the image in it and asks what to call it. the next
+// `!pin NAME` from the same person in the same channel pins it.
+const (
+	// how long lasagnad waits for a name after a reaction
+	pendingPinTTL = 5 * time.Minute
+
+	// the most reactions that can be waiting for a name at once. when there are
+	// more, the oldest gets forgotten.
+	maxPendingPins = 1024
+)
+
+var (
+	// ErrMessageNotFound is returned when a reacted to message can't be found,
+	// usually because it was deleted.
+	ErrMessageNotFound = fmt.Errorf("slack: message not found")
+
+	// links in message text. slack wraps them in < > and sometimes adds a
+	// |label to the end.
+	slackLinkRe = regexp.MustCompile(`<(https?://[^|>\s]+)(?:\|[^>]*)?>`)
+	bareLinkRe  = regexp.MustCompile(`https?://[^\s<>]+`)
+)
+
+type pendingPinKey struct {
+	Channel string
+	User    string
+}
+
+type pendingPin struct {
+	URL     string
+	Expires time.Time
+}
+
+// pendingPins are images that have been reacted to but haven't been named yet.
+// the zero value is ready to use.
+type pendingPins struct {
+	mu   sync.Mutex
+	pins map[pendingPinKey]pendingPin
+
+	// the current time. defaults to time.Now
+	now func() time.Time
+}
+
+func (p *pendingPins) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// remember an image a user reacted to in a channel, replacing anything they
+// reacted to before.
+func (p *pendingPins) put(channel, user, url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock()
+	if p.pins == nil {
+		p.pins = make(map[pendingPinKey]pendingPin)
+	}
+
+	// forget anything that's expired, and if that's not enough, whatever's
+	// closest to expiring.
+	var oldest pendingPinKey
+	var oldestExpires time.Time
+	for k, pin := range p.pins {
+		if now.After(pin.Expires) {
+			delete(p.pins, k)
+			continue
+		}
+		if oldestExpires.IsZero() || pin.Expires.Before(oldestExpires) {
+			oldest, oldestExpires = k, pin.Expires
+		}
+	}
+	if len(p.pins) >= maxPendingPins {
+		delete(p.pins, oldest)
+	}
+
+	p.pins[pendingPinKey{channel, user}] = pendingPin{URL: url, Expires: now.Add(pendingPinTTL)}
+}
+
+// take the image a user reacted to in a channel, if there is one and it hasn't
+// expired.
+func (p *pendingPins) take(channel, user string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := pendingPinKey{channel, user}
+	pin, ok := p.pins[key]
+	if !ok {
+		return "", false
+	}
+	delete(p.pins, key)
+
+	if p.clock().After(pin.Expires) {
+		return "", false
+	}
+	return pin.URL, true
+}
+
+// true if a reaction should start a pin.
+func (b *bot) isPinReaction(event *slack.ReactionAddedEvent) bool {
+	return b.PinReaction != "" &&
+		event.Reaction == b.PinReaction &&
+		event.Item.Type == "message" &&
+		event.User != b.UserID
+}
+
+// a reaction doesn't come with a message to reply to, so make one up that
+// looks like the user who reacted said something in the channel the reacted
+// to message is in.
+func reactionMessage(event *slack.ReactionAddedEvent) *slack.MessageEvent {
+	message := &slack.MessageEvent{}
+	message.Type = "message"
+	message.Channel = event.Item.Channel
+	message.User = event.User
+	return message
+}
+
+// handle a pin reaction. runs on a worker pool, see dispatch.
+func (b *bot) handleReaction(ctx context.Context, log logrus.FieldLogger, requestID string, event *slack.ReactionAddedEvent) {
+	log = log.WithFields(logrus.Fields{"cmd": "reaction", "reaction": event.Reaction})
+	if err := ctx.Err(); err != nil {
+		log.WithField("error", err).Info("timed out")
+		return
+	}
+
+	startedAt := time.Now()
+	defer func() {
+		elapsed := time.Since(startedAt)
+		log.WithField("elapsed_ms", int64(elapsed/time.Millisecond)).Info("done")
+		commandsTotal.WithLabelValues("reaction").Inc()
+		commandDuration.WithLabelValues("reaction").Observe(elapsed.Seconds())
+	}()
+
+	b.runCommand(ctx, log, requestID, reactionMessage(event), b.handlePinReaction, []string{event.Item.Timestamp})
+}
+
+// find the image in a reacted to message and ask what to call it. args is the
+// timestamp of the message.
+func (b *bot) handlePinReaction(ctx context.Context, log logrus.FieldLogger, message *slack.MessageEvent, args []string) {
+	ts := args[0]
+	log = log.WithField("ts", ts)
+
+	reacted, err := b.fetchMessage(ctx, message.Channel, ts)
+	if err == ErrMessageNotFound {
+		log.Info("reacted to message not found")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("fetching reacted to message failed")
+		b.reply(ctx, log, message, genericErrorResponse)
+		return
+	}
+
+	// this version of the slack client doesn't know about the files on a
+	// file_share message, so look the upload up the same way !pin does. its
+	// permalink gets pinned with the bot's token like any other slack file.
+	var link string
+	if reacted.SubType == "file_share" && reacted.File == nil {
+		shared := slack.MessageEvent(*reacted)
+		shared.Channel = message.Channel
+		file, err := b.messageFile(ctx, &shared)
+		if err != nil {
+			log.WithError(err).Error("finding shared file failed")
+			b.reply(ctx, log, message, genericErrorResponse)
+			return
+		}
+		if file != nil {
+			link = file.Permalink
+		}
+	}
+	if link == "" {
+		var ok bool
+		if link, ok = messageImageURL(reacted); !ok {
+			b.reply(ctx, log, message, "there's nothing in there i can pin :(")
+			return
+		}
+	}
+
+	b.pending.put(message.Channel, message.User, link)
+	log.WithField("url", link).Info("waiting for a name")
+	b.reply(ctx, log, message, fmt.Sprintf("<@%s> ooh, what should i pin that as? say `!pin NAME` in the next %d minutes.", message.User, int(pendingPinTTL/time.Minute)))
+}
+
+// fetch a single message by its timestamp. messages in threads aren't in a
+// channel's history, so look for them in replies if they're not there.
+func (b *bot) fetchMessage(ctx context.Context, channel, ts string) (*slack.Message, error) {
+	history, err := b.Slack.GetConversationHistoryContext(ctx, &slack.GetConversationHistoryParameters{
+		ChannelID: channel,
+		Latest:    ts,
+		Inclusive: true,
+		Limit:     1,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "slack: fetching history failed")
+	}
+	for i := range history.Messages {
+		if history.Messages[i].Timestamp == ts {
+			return &history.Messages[i], nil
+		}
+	}
+
+	replies, _, _, err := b.Slack.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+		ChannelID: channel,
+		Timestamp: ts,
+		Latest:    ts,
+		Inclusive: true,
+		Limit:     1,
+	})
+	if err != nil && err.Error() == "thread_not_found" {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "slack: fetching replies failed")
+	}
+	for i := range replies {
+		if replies[i].Timestamp == ts {
+			return &replies[i], nil
+		}
+	}
+
+	return nil, ErrMessageNotFound
+}
+
+// find the URL of the image in a message. uploaded files win, then links in
+// the text, then images in attachments and unfurls.
+func messageImageURL(message *slack.Message) (string, bool) {
+	if message.File != nil && message.File.Permalink != "" {
+		return message.File.Permalink, true
+	}
+	if match := slackLinkRe.FindStringSubmatch(message.Text); match != nil {
+		return match[1], true
+	}
+	for _, attachment := range message.Attachments {
+		if attachment.ImageURL != "" {
+			return attachment.ImageURL, true
+		}
+	}
+	if link := bareLinkRe.FindString(message.Text); link != "" {
+		return link, true
+	}
+	return "", false
+}
+
+// slack sends reactions without the colons, but people configure them with.
+func reactionName(reaction string) string {
+	return strings.Trim(strings.TrimSpace(reaction), ":")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingPins(t *testing.T) {
+	now := time.Unix(1234, 0)
+	pending := &pendingPins{now: func() time.Time { return now }}
+
+	_, ok := pending.take("C1234", "U1234")
+	assert.False(t, ok)
+
+	pending.put("C1234", "U1234", "https://example.com/garf.gif")
+	pending.put("C1234", "U1234", "https://example.com/odie.gif")
+	_, ok = pending.take("C5678", "U1234")
+	assert.False(t, ok, "pending pins are per channel")
+
+	url, ok := pending.take("C1234", "U1234")
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.com/odie.gif", url, "reacting again should replace the pending pin")
+	_, ok = pending.take("C1234", "U1234")
+	assert.False(t, ok, "pending pins can only be taken once")
+
+	pending.put("C1234", "U1234", "https://example.com/garf.gif")
+	now = now.Add(pendingPinTTL + time.Second)
+	_, ok = pending.take("C1234", "U1234")
+	assert.False(t, ok, "pending pins should expire")
+}
+
+func TestMessageImageURL(t *testing.T) {
+	tcs := []struct {
+		text        string
+		attachments []slack.Attachment
+		url         string
+	}{
+		{text: "<https://example.com/garf.gif>", url: "https://example.com/garf.gif"},
+		{text: "look <https://example.com/garf.gif|garf> and <https://example.com/odie.gif>", url: "https://example.com/garf.gif"},
+		{text: "https://example.com/garf.gif", url: "https://example.com/garf.gif"},
+		{
+			text:        "garf",
+			attachments: []slack.Attachment{{}, {ImageURL: "https://example.com/garf.gif"}},
+			url:         "https://example.com/garf.gif",
+		},
+		{text: "<mailto:garf@example.com>"},
+		{text: "garf"},
+	}
+
+	for _, tc := range tcs {
+		message := &slack.Message{}
+		message.Text, message.Attachments = tc.text, tc.attachments
+
+		url, ok := messageImageURL(message)
+		assert.Equal(t, tc.url != "", ok, "%q: wrong ok", tc.text)
+		assert.Equal(t, tc.url, url, "%q: wrong url", tc.text)
+	}
+}
+
+func TestReactionName(t *testing.T) {
+	assert.Equal(t, "pushpin", reactionName(":pushpin:"))
+	assert.Equal(t, "pushpin", reactionName(" pushpin "))
+	assert.Equal(t, "", reactionName(""))
+}
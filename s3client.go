@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// the region to sign requests for when there's a custom endpoint but no
+// region. it's what MinIO expects out of the box, and most other S3-compatible
+// stores don't care.
+const defaultEndpointRegion = "us-east-1"
+
+// an s3Config is how to connect to S3, or to something else that speaks the S3
+// API like MinIO, Ceph or R2. anything left empty comes from the environment
+// the same way it does for the aws cli.
+type s3Config struct {
+	// the url of an S3-compatible endpoint. empty means AWS.
+	Endpoint string
+	Region   string
+
+	// use endpoint/bucket/key urls instead of bucket.endpoint/key. most
+	// S3-compatible stores need this.
+	PathStyle bool
+
+	// static credentials. either both are set or neither is.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// build an S3 client. imgdump builds its urls with the same client, so they
+// use the same endpoint and addressing style.
+func (c s3Config) client() (*s3.S3, error) {
+	config := aws.NewConfig()
+	if c.Endpoint != "" {
+		config.WithEndpoint(c.Endpoint)
+		if c.Region == "" {
+			config.WithRegion(defaultEndpointRegion)
+		}
+	}
+	if c.Region != "" {
+		config.WithRegion(c.Region)
+	}
+	if c.PathStyle {
+		config.WithS3ForcePathStyle(true)
+	}
+	if c.AccessKeyID != "" || c.SecretAccessKey != "" {
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return nil, fmt.Errorf("static credentials need both an access key id and a secret access key")
+		}
+		config.WithCredentials(credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, ""))
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3ConfigURLs(t *testing.T) {
+	key := "lasagna/mork/7287194dfdb24cb741413ebb7f9b121d.gif"
+
+	tcs := []struct {
+		config   s3Config
+		expected string
+	}{
+		{
+			config:   s3Config{Region: "us-east-1"},
+			expected: "https://garf.s3.amazonaws.com/" + key,
+		},
+		{
+			config:   s3Config{Region: "ap-southeast-2", PathStyle: true},
+			expected: "https://s3.ap-southeast-2.amazonaws.com/garf/" + key,
+		},
+		{
+			config:   s3Config{Endpoint: "http://localhost:9000", PathStyle: true},
+			expected: "http://localhost:9000/garf/" + key,
+		},
+		{
+			config:   s3Config{Endpoint: "https://minio.example.com", Region: "garfland"},
+			expected: "https://garf.minio.example.com/" + key,
+		},
+	}
+
+	for _, tc := range tcs {
+		client, err := tc.config.client()
+		require.NoError(t, err)
+
+		dump := &imgdump{Bucket: "garf", S3: client}
+		assert.Equal(t, tc.expected, dump.keyURL(key).String(), "%+v: wrong url", tc.config)
+	}
+}
+
+func TestS3ConfigCredentials(t *testing.T) {
+	client, err := s3Config{Region: "us-east-1", AccessKeyID: "AKIDGARF", SecretAccessKey: "lasagna"}.client()
+	require.NoError(t, err)
+	creds, err := client.Config.Credentials.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "AKIDGARF", creds.AccessKeyID)
+
+	_, err = s3Config{AccessKeyID: "AKIDGARF"}.client()
+	assert.Error(t, err, "half a set of credentials shouldn't work")
+	_, err = s3Config{SecretAccessKey: "lasagna"}.client()
+	assert.Error(t, err, "half a set of credentials shouldn't work")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// the ways an imgdump can hand out urls for its images. slack has to be able to
+// fetch whatever it's given, so:
+//
+//   - public urls are plain S3 urls. the objects (or the whole bucket) have to
+//     be publicly readable.
+//   - presigned urls work with a private bucket, but only for a while. every
+//     !show signs a new url, but urls that have already been posted stop
+//     working once they expire.
+//   - cdn urls are a base url with an object's key on the end, for putting
+//     something like CloudFront in front of a private bucket.
+const (
+	urlModePublic    = "public"
+	urlModePresigned = "presigned"
+	urlModeCDN       = "cdn"
+)
+
+// S3 won't presign a url for any longer than a week.
+const maxPresignedURLLifetime = 7 * 24 * time.Hour
+
+// the canned ACL that means "don't set an ACL" in the config. an empty string
+// would be nicer, but it's hard to tell apart from not setting the acl at all.
+const noACL = "none"
+
+// the url for an object in the dump's bucket.
+//
+// public and presigned urls are built by the S3 client, so they match the
+// region and endpoint it's configured with. if the client can't build a url,
+// which only happens when it's missing a region or credentials and can't do
+// much else either, this falls back to a plain us-east-1 url.
+func (dump *imgdump) keyURL(key string) *url.URL {
+	switch dump.URLMode {
+	case urlModeCDN:
+		u := *dump.BaseURL
+		u.Path = path.Join("/", u.Path, key)
+		return &u
+	case urlModePresigned:
+		req, _ := dump.S3.GetObjectRequest(&s3.GetObjectInput{Bucket: &dump.Bucket, Key: &key})
+		signed, err := req.Presign(dump.URLLifetime)
+		if err != nil {
+			break
+		}
+		if u, err := url.Parse(signed); err == nil {
+			return u
+		}
+	default:
+		req, _ := dump.S3.GetObjectRequest(&s3.GetObjectInput{Bucket: &dump.Bucket, Key: &key})
+		if err := req.Build(); err != nil {
+			break
+		}
+		u := *req.HTTPRequest.URL
+		u.RawQuery = ""
+		return &u
+	}
+
+	return s3keyURL(dump.Bucket, key)
+}
+
+// the ACL to give objects that have to be readable from the url that keyURL
+// hands out, or nil to leave the bucket's default alone.
+func (dump *imgdump) objectACL() *string {
+	if dump.ACL == "" {
+		return nil
+	}
+	return &dump.ACL
+}
+
+// check an imgdump's url and acl settings.
+func validS3URLConfig(mode string, lifetime time.Duration, baseURL *url.URL) error {
+	switch mode {
+	case urlModePublic:
+	case urlModePresigned:
+		if lifetime <= 0 || lifetime > maxPresignedURLLifetime {
+			return fmt.Errorf("presigned urls need a lifetime between 0 and %s", maxPresignedURLLifetime)
+		}
+	case urlModeCDN:
+		if baseURL == nil || baseURL.Scheme == "" || baseURL.Host == "" {
+			return fmt.Errorf("cdn urls need an absolute base url")
+		}
+	default:
+		return fmt.Errorf("unknown url mode %q", mode)
+	}
+	return nil
+}
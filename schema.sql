@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS pins (
+    name         TEXT      NOT NULL,
+    imgid        TEXT      NOT NULL,
+    filetype     TEXT      NOT NULL,
+    uploaded_by  TEXT      NOT NULL DEFAULT '',
+    channel      TEXT      NOT NULL DEFAULT '',
+    original_url TEXT      NOT NULL DEFAULT '',
+    size_bytes   INTEGER   NOT NULL DEFAULT 0,
+    width        INTEGER   NOT NULL DEFAULT 0,
+    height       INTEGER   NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL,
+    legacy       INTEGER   NOT NULL DEFAULT 0,
+    PRIMARY KEY (name, imgid)
+);
+
+CREATE TABLE IF NOT EXISTS pin_tags (
+    name         TEXT      NOT NULL,
+    imgid        TEXT      NOT NULL,
+    tag          TEXT      NOT NULL,
+    PRIMARY KEY (name, imgid, tag)
+);
+
+CREATE INDEX IF NOT EXISTS pin_tags_by_tag ON pin_tags (tag);
+
+CREATE TABLE IF NOT EXISTS pin_favorites (
+    name         TEXT      NOT NULL,
+    imgid        TEXT      NOT NULL,
+    user_id      TEXT      NOT NULL,
+    PRIMARY KEY (name, imgid, user_id)
+);
@@ -0,0 +1,152 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the most shuffle bags a shuffler keeps around. when there are more, the
+// least recently used bag is thrown out.
+const maxShuffleBags = 1024
+
+// the most times an image can come up in one trip through a shuffle bag, no
+// matter how many favorites it has.
+const maxImageWeight = 10
+
+// identifies a single pinned image. the same image pinned under two names is
+// two different pins.
+type pinKey struct {
+	Name string
+	ID   imgid
+}
+
+// a shuffler picks images for !show like drawing from a bag: every image in
+// a bag comes out once before any image comes out again. images can be
+// weighted, in which case they go in the bag more than once.
+//
+// there's a bag for every channel and every name or tag shown in it, so
+// channels don't use up each other's bags.
+type shuffler struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+	bags map[string]*shuffleBag
+}
+
+type shuffleBag struct {
+	// the number of times each image has been drawn this trip through the bag
+	drawn map[pinKey]int
+	// the last image drawn, so it doesn't come up twice in a row when the bag
+	// gets refilled
+	last     pinKey
+	lastUsed time.Time
+}
+
+// make a new shuffler that uses the given seed. use randomSeed unless you
+// want the same images every time.
+func newShuffler(seed int64) *shuffler {
+	return &shuffler{
+		rand: rand.New(rand.NewSource(seed)),
+		bags: make(map[string]*shuffleBag),
+	}
+}
+
+// a seed for a shuffler from crypto/rand, so that every restart doesn't show
+// the same images in the same order.
+func randomSeed() int64 {
+	var bs [8]byte
+	if _, err := crand.Read(bs[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(bs[:]))
+}
+
+// pick the next image out of the bag for channel and key. imgs is everything
+// that should be in the bag right now, so images pinned or unpinned halfway
+// through a trip through the bag are handled. weights are optional - anything
+// without a weight has a weight of 1. imgs must not be empty.
+func (s *shuffler) next(channel, key string, imgs []img, weights map[pinKey]int) img {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bagKey := channel + "\x00" + key
+	bag, ok := s.bags[bagKey]
+	if !ok {
+		s.evict()
+		bag = &shuffleBag{drawn: make(map[pinKey]int)}
+		s.bags[bagKey] = bag
+	}
+	bag.lastUsed = time.Now()
+
+	var skip *pinKey
+	remaining := func(i img) int {
+		k := pinKey{i.Name, i.ID}
+		if skip != nil && *skip == k {
+			return 0
+		}
+		weight := 1
+		if w, ok := weights[k]; ok && w > 1 {
+			weight = w
+		}
+		if weight > maxImageWeight {
+			weight = maxImageWeight
+		}
+		if left := weight - bag.drawn[k]; left > 0 {
+			return left
+		}
+		return 0
+	}
+
+	total := 0
+	for _, i := range imgs {
+		total += remaining(i)
+	}
+
+	// the bag is empty, so start over. whatever came out last stays in the
+	// bag but is skipped this once, so nobody sees the same image twice in a
+	// row.
+	if total == 0 {
+		bag.drawn = make(map[pinKey]int)
+		skip = &bag.last
+		for _, i := range imgs {
+			total += remaining(i)
+		}
+		if total == 0 {
+			skip = nil
+			for _, i := range imgs {
+				total += remaining(i)
+			}
+		}
+	}
+
+	n := s.rand.Intn(total)
+	for _, i := range imgs {
+		n -= remaining(i)
+		if n < 0 {
+			k := pinKey{i.Name, i.ID}
+			bag.drawn[k]++
+			bag.last = k
+			return i
+		}
+	}
+	panic("shuffler: ran out of images")
+}
+
+// throw out the least recently used bag if there are too many. must be called
+// with mu held.
+func (s *shuffler) evict() {
+	if len(s.bags) < maxShuffleBags {
+		return
+	}
+
+	var oldest string
+	var oldestUsed time.Time
+	for k, bag := range s.bags {
+		if oldest == "" || bag.lastUsed.Before(oldestUsed) {
+			oldest, oldestUsed = k, bag.lastUsed
+		}
+	}
+	delete(s.bags, oldest)
+}
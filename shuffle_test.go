@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testImgs(name string, n int) []img {
+	var imgs []img
+	for i := 0; i < n; i++ {
+		imgs = append(imgs, img{Name: name, ID: newImgid([]byte(fmt.Sprint(i))), Filetype: "gif"})
+	}
+	return imgs
+}
+
+func TestShufflerShowsEverythingBeforeRepeating(t *testing.T) {
+	s := newShuffler(1)
+	imgs := testImgs("garf", 10)
+
+	var last pinKey
+	for trip := 0; trip < 20; trip++ {
+		seen := make(map[pinKey]bool)
+		for range imgs {
+			i := s.next("C1234", "garf", imgs, nil)
+			k := pinKey{i.Name, i.ID}
+			assert.False(t, seen[k], "trip %d: repeated an image", trip)
+			assert.NotEqual(t, last, k, "trip %d: showed the same image twice in a row", trip)
+			seen[k] = true
+			last = k
+		}
+		assert.Len(t, seen, len(imgs))
+	}
+}
+
+func TestShufflerSeparateBags(t *testing.T) {
+	s := newShuffler(1)
+	imgs := testImgs("garf", 5)
+
+	// using up one channel's bag doesn't use up anyone else's
+	seen := make(map[string]map[pinKey]bool)
+	for _, channel := range []string{"C1", "C2"} {
+		for _, key := range []string{"garf", "#cats"} {
+			bag := channel + key
+			seen[bag] = make(map[pinKey]bool)
+			for range imgs {
+				i := s.next(channel, key, imgs, nil)
+				seen[bag][pinKey{i.Name, i.ID}] = true
+			}
+		}
+	}
+	for bag, imgs := range seen {
+		assert.Len(t, imgs, 5, "bag %s", bag)
+	}
+}
+
+func TestShufflerChangingImages(t *testing.T) {
+	s := newShuffler(1)
+	imgs := testImgs("garf", 4)
+
+	first := s.next("C1234", "garf", imgs, nil)
+
+	// unpin the image that was just shown and pin a new one. the new one
+	// should show up before the bag is refilled.
+	var remaining []img
+	for _, i := range imgs {
+		if i.ID != first.ID {
+			remaining = append(remaining, i)
+		}
+	}
+	added := img{Name: "garf", ID: newImgid([]byte("new")), Filetype: "gif"}
+	remaining = append(remaining, added)
+
+	seen := make(map[pinKey]bool)
+	for range remaining {
+		i := s.next("C1234", "garf", remaining, nil)
+		seen[pinKey{i.Name, i.ID}] = true
+	}
+	assert.Len(t, seen, len(remaining))
+	assert.True(t, seen[pinKey{added.Name, added.ID}])
+
+	// a single image is always shown, even twice in a row
+	only := remaining[:1]
+	for n := 0; n < 3; n++ {
+		assert.Equal(t, only[0].ID, s.next("C1234", "garf", only, nil).ID)
+	}
+}
+
+func TestShufflerWeights(t *testing.T) {
+	s := newShuffler(1)
+	imgs := testImgs("garf", 3)
+	favorite := pinKey{imgs[0].Name, imgs[0].ID}
+	weights := map[pinKey]int{favorite: 3}
+
+	counts := make(map[pinKey]int)
+	for n := 0; n < 5*100; n++ {
+		i := s.next("C1234", "garf", imgs, weights)
+		counts[pinKey{i.Name, i.ID}]++
+	}
+
+	// every trip through the bag has the favorite 3 times and everything else
+	// once
+	assert.Equal(t, 300, counts[favorite])
+	for _, i := range imgs[1:] {
+		assert.Equal(t, 100, counts[pinKey{i.Name, i.ID}])
+	}
+
+	// weights are capped
+	s = newShuffler(1)
+	weights[favorite] = 1000
+	counts = make(map[pinKey]int)
+	for n := 0; n < maxImageWeight+2; n++ {
+		i := s.next("C1234", "garf", imgs, weights)
+		counts[pinKey{i.Name, i.ID}]++
+	}
+	assert.Equal(t, maxImageWeight, counts[favorite])
+}
+
+func TestShufflerEvictsBags(t *testing.T) {
+	s := newShuffler(1)
+	imgs := testImgs("garf", 2)
+
+	for n := 0; n < maxShuffleBags+10; n++ {
+		s.next(fmt.Sprintf("C%d", n), "garf", imgs, nil)
+	}
+	require.Len(t, s.bags, maxShuffleBags)
+
+	_, ok := s.bags["C0\x00garf"]
+	assert.False(t, ok, "the oldest bag should have been evicted")
+}
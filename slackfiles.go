@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+// images uploaded to slack live at a url_private on files.slack.com, which
+// needs the bot's token to download. without it slack sends back a login
+// page.
+//
+// a file can be pinned with its permalink, like any other link, or by saying
+// `!pin NAME` as the comment on the upload.
+const slackFileHost = "files.slack.com"
+
+// how far before a file_share message its file could have been created. files
+// are created as they're uploaded, so big files on slow connections can be a
+// while.
+const slackFileWindow = 60
+
+// file permalinks look like https://team.slack.com/files/U1234/F1234/garf.gif
+var slackPermalinkRe = regexp.MustCompile(`^https://[a-z0-9-]+\.slack\.com/files/[A-Z0-9]+/(F[A-Z0-9]+)(?:/|$)`)
+
+// the id of the file a permalink points to, if it's a file permalink.
+func permalinkFileID(u *url.URL) (string, bool) {
+	match := slackPermalinkRe.FindStringSubmatch(u.String())
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// look up a file by its id.
+func (b *bot) slackFile(ctx context.Context, id string) (*slack.File, error) {
+	file, _, _, err := b.Slack.GetFileInfoContext(ctx, id, 0, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "slack: fetching file info failed")
+	}
+	return file, nil
+}
+
+// find the file uploaded with a message. returns nil if there isn't one.
+//
+// slack used to send a file along with every file_share message, and now sends
+// a list of files that this version of the slack client doesn't know about. if
+// it's not there, look for files the user uploaded to the channel right before
+// the message.
+func (b *bot) messageFile(ctx context.Context, message *slack.MessageEvent) (*slack.File, error) {
+	if message.File != nil {
+		return b.slackFile(ctx, message.File.ID)
+	}
+	if message.SubType != "file_share" {
+		return nil, nil
+	}
+
+	seconds, err := strconv.ParseFloat(message.Timestamp, 64)
+	if err != nil {
+		return nil, fmt.Errorf("slack: invalid message timestamp %q", message.Timestamp)
+	}
+
+	params := slack.NewGetFilesParameters()
+	params.User = message.User
+	params.Channel = message.Channel
+	params.Types = "images"
+	params.TimestampFrom = slack.JSONTime(int64(seconds) - slackFileWindow)
+	params.TimestampTo = slack.JSONTime(int64(seconds) + 1)
+	files, _, err := b.Slack.GetFilesContext(ctx, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "slack: listing files failed")
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	// the newest file is the one that was just shared
+	newest := &files[0]
+	for i := range files {
+		if files[i].Created > newest.Created {
+			newest = &files[i]
+		}
+	}
+	return newest, nil
+}
+
+// download a slack file with the bot's token. the token only ever gets sent to
+// files.slack.com.
+func fetchSlackFile(ctx context.Context, client *http.Client, file *slack.File, token string, limits imageLimits) ([]byte, string, error) {
+	u, err := url.Parse(file.URLPrivate)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "slack: invalid file url")
+	}
+	if u.Scheme != "https" || !strings.EqualFold(u.Hostname(), slackFileHost) {
+		return nil, "", ErrForbiddenURL
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	return fetchImage(ctx, client, u, header, limits)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nlopes/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// a client that sends every request to server, no matter what host it's for.
+// requests are recorded in sent.
+func testRedirectingClient(server string, sent *[]*http.Request) *http.Client {
+	target, _ := url.Parse(server)
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		*sent = append(*sent, r)
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+}
+
+func TestPermalinkFileID(t *testing.T) {
+	tcs := []struct {
+		url string
+		id  string
+	}{
+		{url: "https://garf.slack.com/files/U1234/F5678/garf.gif", id: "F5678"},
+		{url: "https://garf.slack.com/files/U1234/F5678", id: "F5678"},
+		{url: "https://garf.slack.com/archives/C1234/p1234"},
+		{url: "https://example.com/files/U1234/F5678/garf.gif"},
+		{url: "http://garf.slack.com/files/U1234/F5678/garf.gif"},
+	}
+
+	for _, tc := range tcs {
+		u, err := url.Parse(tc.url)
+		require.NoError(t, err)
+
+		id, ok := permalinkFileID(u)
+		assert.Equal(t, tc.id != "", ok, "%s: wrong ok", tc.url)
+		assert.Equal(t, tc.id, id, "%s: wrong id", tc.url)
+	}
+}
+
+func TestFetchSlackFile(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16))))
+	server := testImageServer(buf.Bytes(), false)
+	defer server.Close()
+
+	var sent []*http.Request
+	client := testRedirectingClient(server.URL, &sent)
+
+	ctx := context.Background()
+	file := &slack.File{URLPrivate: "https://files.slack.com/files-pri/T1234-F5678/garf.png"}
+	bs, filetype, err := fetchSlackFile(ctx, client, file, "xoxb-garf", testImageLimits)
+	require.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), bs)
+	assert.Equal(t, "png", filetype)
+	require.Len(t, sent, 1)
+	assert.Equal(t, "Bearer xoxb-garf", sent[0].Header.Get("Authorization"))
+
+	// the token never goes anywhere but slack
+	for _, u := range []string{
+		"https://example.com/garf.png",
+		"http://files.slack.com/files-pri/T1234-F5678/garf.png",
+		"https://files.slack.com.example.com/garf.png",
+	} {
+		_, _, err := fetchSlackFile(ctx, client, &slack.File{URLPrivate: u}, "xoxb-garf", testImageLimits)
+		assert.Equal(t, ErrForbiddenURL, err, "%s: should be forbidden", u)
+	}
+	assert.Len(t, sent, 1)
+}
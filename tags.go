@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tags are extra labels on images, so that images pinned under different names
+// can be found together with `!show #tag`.
+//
+// an imgdump keeps tags as S3 object tags, with the tag as the key and an empty
+// value, and a localdump keeps them in a hidden json file next to each image.
+// S3 can't find objects by tag, so finding tagged images without an index means
+// checking every image.
+//
+// tags are normalized like pin names, but S3 only allows letters, numbers, and
+// a little punctuation in tags, so tags can't have emoji in them.
+const (
+	maxTagLength    = 64
+	maxTagsPerImage = 10
+)
+
+var (
+	// ErrInvalidTag is returned when a tag isn't a valid tag.
+	ErrInvalidTag = fmt.Errorf("imgdump: invalid tag")
+
+	// ErrTooManyTags is returned from an imageStore when tagging an image would
+	// give it more than maxTagsPerImage tags.
+	ErrTooManyTags = fmt.Errorf("imgdump: too many tags")
+)
+
+// normalize a tag that came from a person. a leading # is optional.
+func normalizeTag(tag string) (string, error) {
+	if !utf8.ValidString(tag) {
+		return "", ErrInvalidTag
+	}
+
+	tag = foldPinName(strings.TrimPrefix(tag, "#"))
+	if !validTag(tag) {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// true if tag is a valid, normalized tag.
+func validTag(tag string) bool {
+	if length := utf8.RuneCountInString(tag); length == 0 || length > maxTagLength {
+		return false
+	}
+	if !validPinNameSegment(tag) || foldPinName(tag) != tag {
+		return false
+	}
+
+	for _, r := range tag {
+		if !(unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r) || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// merge two sets of tags, sorted and without duplicates.
+func mergeTags(existing, added []string) []string {
+	seen := make(map[string]bool, len(existing)+len(added))
+	var merged []string
+	for _, tag := range append(append([]string(nil), existing...), added...) {
+		if !seen[tag] {
+			seen[tag] = true
+			merged = append(merged, tag)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// true if tags has tag in it
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tcs := []struct {
+		tag        string
+		normalized string
+		valid      bool
+	}{
+		{tag: "cats", normalized: "cats", valid: true},
+		{tag: "#cats", normalized: "cats", valid: true},
+		{tag: "#CATS", normalized: "cats", valid: true},
+		{tag: "fat-cats_2", normalized: "fat-cats_2", valid: true},
+		{tag: "#café", normalized: "café", valid: true},
+		{tag: strings.Repeat("a", maxTagLength), normalized: strings.Repeat("a", maxTagLength), valid: true},
+
+		{tag: ""},
+		{tag: "#"},
+		{tag: "##cats"},
+		{tag: "-cats"},
+		{tag: "comics/cats"},
+		{tag: "cats!"},
+		{tag: "🍝"},
+		{tag: ":spaghetti:"},
+		{tag: "../cats"},
+		{tag: strings.Repeat("a", maxTagLength+1)},
+	}
+
+	for _, tc := range tcs {
+		normalized, err := normalizeTag(tc.tag)
+		if tc.valid {
+			assert.NoError(t, err, "%q: should be valid", tc.tag)
+			assert.Equal(t, tc.normalized, normalized, "%q: wrong normalized tag", tc.tag)
+		} else {
+			assert.Equal(t, ErrInvalidTag, err, "%q: should be invalid", tc.tag)
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, mergeTags([]string{"c", "a"}, []string{"b", "a", "b"}))
+	assert.Equal(t, []string{"a"}, mergeTags(nil, []string{"a"}))
+	assert.Empty(t, mergeTags(nil, nil))
+}